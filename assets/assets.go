@@ -0,0 +1,92 @@
+// Package assets embeds the stylesheet, scripts and images served under
+// /assets/, so the binary runs from any directory without a network.
+// htmx.min.js is htmx 1.9.12, vendored as released. output.css is generated
+// by `npm run build` and embedded when present; without it pages are served
+// unstyled.
+package assets
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Everything in the directory is embedded so the build never depends on a
+// generated file, the Go sources are skipped when the assets are indexed.
+//
+//go:embed *
+var files embed.FS
+
+type asset struct {
+	name string
+	hash string
+	data []byte
+}
+
+var (
+	// hashed maps names such as output.1a2b3c4d5e6f.css to their asset
+	hashed = map[string]*asset{}
+	byName = map[string]*asset{}
+)
+
+// Assets never change at runtime, so their hashes are computed once
+func init() {
+	entries, err := fs.ReadDir(files, ".")
+	if err != nil {
+		panic(err)
+	}
+	for _, entry := range entries {
+		if path.Ext(entry.Name()) == ".go" {
+			continue
+		}
+		data, err := files.ReadFile(entry.Name())
+		if err != nil {
+			panic(err)
+		}
+		sum := sha256.Sum256(data)
+		a := &asset{name: entry.Name(), hash: hex.EncodeToString(sum[:6]), data: data}
+		byName[a.name] = a
+		hashed[hashedName(a.name, a.hash)] = a
+	}
+}
+
+func hashedName(name, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// Path is the URL of an asset with its content hash in the name, so
+// browsers can cache it for good and pick up a new version after an
+// upgrade.
+func Path(name string) string {
+	a, ok := byName[name]
+	if !ok {
+		return "/assets/" + name
+	}
+	return "/assets/" + hashedName(a.name, a.hash)
+}
+
+// Handler serves the assets with the /assets/ prefix already stripped.
+// Hashed names are cached as immutable, plain names are revalidated.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		a, ok := hashed[name]
+		if ok {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else if a, ok = byName[name]; ok {
+			w.Header().Set("Cache-Control", "no-cache")
+		} else {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", `"`+a.hash+`"`)
+		http.ServeContent(w, r, a.name, time.Time{}, bytes.NewReader(a.data))
+	})
+}
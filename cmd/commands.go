@@ -0,0 +1,228 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/parthshahp/booknotes/internal/api"
+	"github.com/parthshahp/booknotes/internal/config"
+	"github.com/parthshahp/booknotes/internal/db"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+const usage = `usage: booknotes [global flags] [command] [flags]
+
+Global flags override the config file and environment:
+  -config file              TOML or YAML config file, or BOOKNOTES_CONFIG
+  -addr address             listen address, or LISTEN_ADDR
+  -db path                  SQLite database, or DATABASE_LOCATION
+  -base-path path           serve below this path, or BASE_PATH
+  -tls-cert file            TLS certificate, or TLS_CERT_FILE
+  -tls-key file             TLS private key, or TLS_KEY_FILE
+  -tls-redirect-addr address
+                            redirect plain HTTP here to HTTPS, or TLS_REDIRECT_ADDR
+  -allow-signup bool        let anyone register, or ALLOW_SIGNUP
+  -backup-dir dir           scheduled backups, or BACKUP_DIR
+  -watch-dir dir            import files dropped here, or WATCH_DIR
+  -log-level info|error     or LOG_LEVEL
+
+Commands:
+  serve                     start the web server (the default)
+  import [-user name] <files...>
+                            import KOReader, Kindle or Kobo files
+  export [-user name] [-format md|json|csv|anki] [-o file] (-book id | -all)
+                            export one book, or the whole library as a zip
+  search [-user name] <query>
+                            print the highlights and notes matching query
+  backup [-o file]          write a JSON backup of the database
+  restore [-replace] [-user name] <backup.json>
+                            load a JSON backup
+  migrate                   upgrade the database schema and exit
+  config print              show the effective configuration
+
+Commands that act on a library use -user, or the first admin account.
+`
+
+// importFiles imports each file as an upload would, printing the outcome
+// of each one. It fails if any file could not be imported.
+func importFiles(env *Env, db *db.DB, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	username := flags.String("user", "", "account to import the files for")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: import [-user name] <files...>")
+	}
+	userID, err := cliUser(db, *username)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, path := range flags.Args() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			failed++
+			continue
+		}
+
+		record, err := api.IngestFile(db, env, userID, ImportSourceCLI, filepath.Base(path), data)
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			failed++
+		case record.Status == ImportDuplicate:
+			fmt.Printf("%s: already imported\n", path)
+		default:
+			fmt.Printf("%s: %d new highlights in %d books\n", path, record.Entries, record.Books)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed to import", failed, flags.NArg())
+	}
+	return nil
+}
+
+// exportBooks writes one book, or the whole library as a zip archive, to -o
+// or stdout.
+func exportBooks(env *Env, db *db.DB, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	username := flags.String("user", "", "account to export from")
+	format := flags.String("format", api.FormatMarkdown, "md, json, csv or anki")
+	bookID := flags.Int("book", 0, "id of the book to export")
+	all := flags.Bool("all", false, "export every book as a zip archive")
+	order := flags.String("order", api.OrderReading, "reading, chronological or reverse")
+	group := flags.String("group", api.GroupChapter, "chapter, page or none")
+	output := flags.String("o", "", "write the export to this file instead of stdout")
+	flags.Parse(args)
+
+	if (*bookID == 0) == !*all {
+		return fmt.Errorf("usage: export [-format md|json|csv|anki] [-o file] (-book id | -all)")
+	}
+	if !api.IsExportFormat(*format) {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	opts, err := api.ParseExportOptions(url.Values{"order": {*order}, "group": {*group}})
+	if err != nil {
+		return err
+	}
+	userID, err := cliUser(db, *username)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if *all {
+		ids, err := api.GetLibraryBookIDs(db, env, userID, api.LibraryFilter{})
+		if err != nil {
+			return err
+		}
+		if err := api.WriteLibraryZip(w, db, env, userID, ids, *format, opts, api.LibraryFilter{}); err != nil {
+			return err
+		}
+		if *output != "" {
+			env.Logger.Info("Exported library", "books", len(ids), "file", *output)
+		}
+		return nil
+	}
+
+	data, err := api.GetExportBook(db, env, userID, strconv.Itoa(*bookID), opts)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no book with id %d", *bookID)
+	}
+	if err != nil {
+		return err
+	}
+	return api.WriteBook(w, data, *format, opts)
+}
+
+// searchHighlights prints the highlights whose text or note contains the
+// query.
+func searchHighlights(env *Env, db *db.DB, args []string) error {
+	flags := flag.NewFlagSet("search", flag.ExitOnError)
+	username := flags.String("user", "", "account to search")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: search [-user name] <query>")
+	}
+	userID, err := cliUser(db, *username)
+	if err != nil {
+		return err
+	}
+
+	entries, err := api.FindHighlights(db, env, userID, strings.Join(flags.Args(), " "))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		fmt.Printf("%s, page %d (book %d)\n", entry.BookTitle, entry.Page, entry.BookID)
+		fmt.Printf("  %s\n", strings.ReplaceAll(entry.Text, "\n", "\n  "))
+		if entry.Note != "" {
+			fmt.Printf("  Note: %s\n", strings.ReplaceAll(entry.Note, "\n", "\n  "))
+		}
+		fmt.Println()
+	}
+	env.Logger.Info("Searched highlights", "found", len(entries))
+	return nil
+}
+
+// migrate brings the schema up to date. Every other command does so before
+// it starts, migrate only makes it possible to upgrade ahead of time.
+func migrate(env *Env, db *db.DB) error {
+	if err := db.InitDB(); err != nil {
+		return err
+	}
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	env.Logger.Info("Migrated database", "version", version)
+	return nil
+}
+
+// printConfig shows the configuration the other commands would run with.
+func printConfig(cfg config.Config, args []string) error {
+	if len(args) != 1 || args[0] != "print" {
+		return fmt.Errorf("usage: config print")
+	}
+	return cfg.Print(os.Stdout)
+}
+
+// cliUser is the account a command acts for, the first admin unless a
+// username is given.
+func cliUser(database *db.DB, username string) (int, error) {
+	var id int
+	var err error
+	if username != "" {
+		err = database.QueryRow(`SELECT id FROM users WHERE username = ?;`, username).Scan(&id)
+	} else {
+		err = database.QueryRow(`SELECT id FROM users WHERE role = ? ORDER BY id LIMIT 1;`, RoleAdmin).Scan(&id)
+	}
+	if err == sql.ErrNoRows {
+		if username != "" {
+			return 0, fmt.Errorf("unknown user %q", username)
+		}
+		return 0, errors.New("no admin account yet, register one or pass -user")
+	}
+	return id, err
+}
@@ -1,48 +1,303 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/rs/cors"
 
 	"github.com/parthshahp/booknotes/internal/api"
+	"github.com/parthshahp/booknotes/internal/backup"
+	"github.com/parthshahp/booknotes/internal/certs"
+	"github.com/parthshahp/booknotes/internal/config"
 	"github.com/parthshahp/booknotes/internal/db"
+	"github.com/parthshahp/booknotes/internal/jobs"
+	"github.com/parthshahp/booknotes/internal/logging"
 	. "github.com/parthshahp/booknotes/internal/types"
+	"github.com/parthshahp/booknotes/internal/watch"
 )
 
 func main() {
 	if err := godotenv.Load(); err != nil {
 		log.Print("No .env file found")
 	}
-	addr := os.Getenv("LISTEN_ADDR")
-	loc := os.Getenv("DATABASE_LOCATION")
 
-	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-	errorLog := log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+	cfg, args, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Print(usage)
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Without a subcommand the server is started
+	command := "serve"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	if command == "help" {
+		fmt.Print(usage)
+		return
+	}
+
+	var logOutput io.Writer = os.Stdout
+	if command != "serve" {
+		// Keep stdout free for the command's output
+		logOutput = os.Stderr
+	}
+	logger := logging.New(logOutput, cfg.Log)
+	// Code still using the log package goes through the same handler
+	slog.SetDefault(logger)
+	fatal := func(err error) {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
 
 	env := Env{
-		InfoLog:  infoLog,
-		ErrorLog: errorLog,
+		Logger:  logger,
+		HTTP:    cfg.HTTP,
+		TLS:     cfg.TLS,
+		Backup:  cfg.Backup,
+		Auth:    cfg.Auth,
+		CORS:    cfg.CORS,
+		Import:  cfg.Import,
+		Watch:   cfg.Watch,
+		Jobs:    cfg.Jobs,
+		Metrics: cfg.Metrics,
+	}
+
+	if command == "config" {
+		if err := printConfig(cfg, args); err != nil {
+			fatal(err)
+		}
+		return
 	}
 
-	db, err := db.OpenDB(loc)
+	db, err := db.OpenDB(cfg.Database)
 	if err != nil {
-		errorLog.Fatal(err)
+		fatal(err)
 	}
 	defer db.CloseDB()
-	db.InitDB()
+	if command != "migrate" {
+		if err := db.InitDB(); err != nil {
+			fatal(err)
+		}
+	}
+
+	switch command {
+	case "serve":
+		err = serve(&env, db, cfg.ListenAddr, cfg.ShutdownTimeout)
+	case "import":
+		err = importFiles(&env, db, args)
+	case "export":
+		err = exportBooks(&env, db, args)
+	case "search":
+		err = searchHighlights(&env, db, args)
+	case "backup":
+		err = backupJSON(&env, db, args)
+	case "restore":
+		err = restoreJSON(&env, db, args)
+	case "migrate":
+		err = migrate(&env, db)
+	default:
+		err = fmt.Errorf("unknown command %q\n\n%s", command, usage)
+	}
+	if err != nil {
+		// Exiting skips the deferred close
+		db.CloseDB()
+		fatal(err)
+	}
+}
+
+// serve runs the server until SIGINT or SIGTERM. It then stops accepting
+// connections and waits up to timeout for in-flight requests, running jobs,
+// backups and watched imports to finish.
+func serve(env *Env, db *db.DB, addr string, timeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	queue := jobs.NewQueue(db, env)
+	handler := api.RoutesInit(env, db, queue)
 
-	c := cors.AllowAll()
-	handler := c.Handler(api.RoutesInit(&env, db))
+	tasks := []func(context.Context){
+		func(ctx context.Context) { backup.Run(ctx, db, env) },
+		func(ctx context.Context) { watch.Run(ctx, db, env) },
+		func(ctx context.Context) { queue.Run(ctx, env.Jobs.Workers) },
+	}
+	var tlsConfig *tls.Config
+	if env.TLS.Enabled() {
+		reloader, err := certs.NewReloader(env.TLS.CertFile, env.TLS.KeyFile, env.Logger)
+		if err != nil {
+			return fmt.Errorf("load TLS certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+		tasks = append(tasks, reloader.Run)
+	}
+
+	var background sync.WaitGroup
+	for _, run := range tasks {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			run(ctx)
+		}()
+	}
+
+	// Without allowed origins browsers keep to the same-origin policy
+	if len(env.CORS.AllowedOrigins) > 0 {
+		handler = cors.New(cors.Options{
+			AllowedOrigins:   env.CORS.AllowedOrigins,
+			AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodDelete},
+			AllowedHeaders:   []string{"Authorization", "Content-Type", "X-CSRF-Token"},
+			AllowCredentials: env.CORS.AllowCredentials,
+		}).Handler(handler)
+	}
+	errorLog := slog.NewLogLogger(env.Logger.Handler(), slog.LevelError)
 	server := http.Server{
-		Addr:     addr,
-		Handler:  handler,
-		ErrorLog: errorLog,
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+		ErrorLog:  errorLog,
+	}
+	servers := []*http.Server{&server}
+
+	listenErr := make(chan error, 2)
+	go func() {
+		env.Logger.Info("Starting server", "addr", addr, "tls", tlsConfig != nil)
+		if tlsConfig != nil {
+			// The certificate comes from TLSConfig
+			listenErr <- server.ListenAndServeTLS("", "")
+		} else {
+			listenErr <- server.ListenAndServe()
+		}
+	}()
+	if env.TLS.RedirectAddr != "" {
+		redirect := &http.Server{
+			Addr:     env.TLS.RedirectAddr,
+			Handler:  api.RedirectToHTTPS(env, addr),
+			ErrorLog: errorLog,
+		}
+		servers = append(servers, redirect)
+		go func() {
+			env.Logger.Info("Redirecting to HTTPS", "addr", redirect.Addr)
+			listenErr <- redirect.ListenAndServe()
+		}()
+	}
+
+	var err error
+	select {
+	case err = <-listenErr:
+	case <-ctx.Done():
+		env.Logger.Info("Shutting down")
+	}
+	// A second signal kills the process straight away
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			env.Logger.Error("Failed to finish requests", "addr", server.Addr, "err", err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-shutdownCtx.Done():
+		env.Logger.Error("Timed out waiting for background work")
+	}
+
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+	return err
+}
+
+// backupJSON writes a JSON backup of the whole database to -o or stdout.
+func backupJSON(env *Env, db *db.DB, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	output := flags.String("o", "", "write the backup to this file instead of stdout")
+	flags.Parse(args)
+
+	dump, err := db.Dump()
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(dump); err != nil {
+		return err
+	}
+
+	if *output != "" {
+		env.Logger.Info("Wrote backup", "books", len(dump.Books), "file", *output)
+	}
+	return nil
+}
+
+// restoreJSON loads a JSON backup, merging it into the library unless -replace
+// is given. Merged rows are given to -user, or the first admin account.
+func restoreJSON(env *Env, database *db.DB, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	replace := flags.Bool("replace", false, "wipe the library before restoring")
+	username := flags.String("user", "", "account that owns the restored books")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: restore [-replace] [-user name] <backup.json>")
+	}
+
+	ownerID, err := cliUser(database, *username)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var dump db.Dump
+	if err := json.NewDecoder(f).Decode(&dump); err != nil {
+		return fmt.Errorf("parse backup: %w", err)
+	}
+
+	if err := database.Restore(&dump, *replace, int64(ownerID)); err != nil {
+		return err
 	}
 
-	infoLog.Printf("Starting server on %s", addr)
-	errorLog.Fatal(server.ListenAndServe())
+	env.Logger.Info("Restored backup", "books", len(dump.Books), "file", flags.Arg(0))
+	return nil
 }
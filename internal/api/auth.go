@@ -0,0 +1,415 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/a-h/templ"
+	"golang.org/x/crypto/bcrypt"
+
+	ui "github.com/parthshahp/booknotes/components"
+	"github.com/parthshahp/booknotes/internal/basepath"
+	"github.com/parthshahp/booknotes/internal/db"
+	"github.com/parthshahp/booknotes/internal/logging"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+const sessionCookie = "booknotes_session"
+
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+var ErrUsernameTaken = errors.New("username is already taken")
+
+// dummyHash is compared against when a username doesn't exist
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("booknotes"), bcrypt.DefaultCost)
+
+type contextKey string
+
+const userKey contextKey = "user"
+
+// CurrentUser returns the user attached to the request by RequireUser.
+func CurrentUser(r *http.Request) User {
+	user, _ := r.Context().Value(userKey).(User)
+	return user
+}
+
+func WithUser(ctx context.Context, user User) context.Context {
+	logging.SetUser(ctx, user.Username)
+	return context.WithValue(ctx, userKey, user)
+}
+
+func CountUsers(db *db.DB) (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM users;`).Scan(&count)
+	return count, err
+}
+
+// CreateUser stores a new account with a bcrypt hashed password.
+func CreateUser(db *db.DB, env *Env, username, password string) (User, error) {
+	if len(password) < 8 {
+		return User{}, errors.New("password must be at least 8 characters")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+
+	return insertUser(db, env, username, string(hash), "")
+}
+
+// insertUser stores a new account. Accounts signed in through single sign-on
+// have no password hash and a role chosen from their groups instead. The
+// first account becomes the admin and takes ownership of any rows created
+// before accounts existed.
+func insertUser(db *db.DB, env *Env, username, hash, role string) (User, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	user, err := createUser(tx, env, username, hash, role)
+	if err != nil {
+		return User{}, err
+	}
+	return user, tx.Commit()
+}
+
+// createUser is insertUser within tx.
+func createUser(tx *sql.Tx, env *Env, username, hash, role string) (User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return User{}, errors.New("username is required")
+	}
+
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM users;`).Scan(&count); err != nil {
+		return User{}, err
+	}
+	if count == 0 {
+		role = RoleAdmin
+	} else if role == "" {
+		role = RoleUser
+	}
+
+	taken, err := usernameTaken(tx, username)
+	if err != nil {
+		return User{}, err
+	}
+	if taken {
+		return User{}, ErrUsernameTaken
+	}
+
+	now := time.Now()
+	res, err := tx.Exec(
+		`INSERT INTO users (username, password_hash, role, created_on) VALUES (?, ?, ?, ?);`,
+		username, hash, role, now.Unix(),
+	)
+	if err != nil {
+		env.Logger.Error("Failed to insert user", "err", err)
+		return User{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+
+	if role == RoleAdmin {
+		for _, table := range []string{"books", "entries", "tags", "collections", "export_templates"} {
+			if _, err := tx.Exec(`UPDATE `+table+` SET user_id = ? WHERE user_id IS NULL;`, id); err != nil {
+				env.Logger.Error("Failed to claim rows", "table", table, "err", err)
+				return User{}, err
+			}
+		}
+	}
+
+	env.Logger.Info("Created account", "role", role, "user", username)
+	return User{ID: int(id), Username: username, Role: role, CreatedOn: now}, nil
+}
+
+func usernameTaken(tx *sql.Tx, username string) (bool, error) {
+	var taken bool
+	err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE username = ?);`, username).Scan(&taken)
+	return taken, err
+}
+
+func Authenticate(db *db.DB, env *Env, username, password string) (User, error) {
+	var user User
+	var hash string
+	var createdOn int64
+	err := db.QueryRow(
+		`SELECT id, username, password_hash, role, created_on FROM users WHERE username = ?;`,
+		strings.TrimSpace(username),
+	).Scan(&user.ID, &user.Username, &hash, &user.Role, &createdOn)
+	if err == sql.ErrNoRows {
+		// Spend the same time as a real check so usernames can't be probed
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return User{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		env.Logger.Error("Failed to query user", "err", err)
+		return User{}, err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return User{}, ErrInvalidCredentials
+	}
+	user.CreatedOn = time.Unix(createdOn, 0)
+	return user, nil
+}
+
+// CreateSession stores a new session for the user and returns the token to
+// hand to the browser. Only a hash of the token is kept in the database.
+func CreateSession(db *db.DB, env *Env, userID int) (string, time.Time, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	csrfToken, err := randomToken(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	expires := now.Add(env.Auth.SessionTTL)
+	_, err = db.Exec(
+		`INSERT INTO sessions (token_hash, user_id, created_on, expires_on, csrf_token) VALUES (?, ?, ?, ?, ?);`,
+		hashToken(token), userID, now.Unix(), expires.Unix(), csrfToken,
+	)
+	if err != nil {
+		env.Logger.Error("Failed to insert session", "err", err)
+		return "", time.Time{}, err
+	}
+
+	return token, expires, nil
+}
+
+// GetSessionUser returns the session's user and its CSRF token.
+func GetSessionUser(db *db.DB, token string) (User, string, error) {
+	var user User
+	var createdOn int64
+	var csrfToken string
+	err := db.QueryRow(`
+    SELECT u.id, u.username, u.role, u.created_on, s.csrf_token
+    FROM sessions s
+    JOIN users u ON s.user_id = u.id
+    WHERE s.token_hash = ? AND s.expires_on > ?;
+  `, hashToken(token), time.Now().Unix()).Scan(&user.ID, &user.Username, &user.Role, &createdOn, &csrfToken)
+	user.CreatedOn = time.Unix(createdOn, 0)
+	return user, csrfToken, err
+}
+
+func DeleteSession(db *db.DB, token string) error {
+	_, err := db.Exec(`DELETE FROM sessions WHERE token_hash = ? OR expires_on <= ?;`, hashToken(token), time.Now().Unix())
+	return err
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RequireUser only lets requests with a valid session through and attaches
+// the user and CSRF token to the request context. Everyone else is sent to
+// the login page. Requests that change anything must also pass checkCSRF.
+func RequireUser(env *Env, db *db.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cookie, err := r.Cookie(sessionCookie)
+			if err == nil {
+				user, csrfToken, err := GetSessionUser(db, cookie.Value)
+				if err == nil {
+					if err := checkCSRF(env, r, csrfToken); err != nil {
+						env.Logger.InfoContext(r.Context(), "Rejected request", "err", err)
+						http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+						return
+					}
+					ctx := WithCSRFToken(WithUser(r.Context(), user), csrfToken)
+					next.ServeHTTP(w, r.WithContext(ctx))
+					return
+				}
+				if err != sql.ErrNoRows {
+					env.Logger.ErrorContext(r.Context(), "Error loading session", "err", err)
+				}
+			}
+
+			redirectToLogin(w, r)
+		})
+	}
+}
+
+// RequireAdmin wraps RequireUser and additionally rejects non-admin users.
+func RequireAdmin(env *Env, db *db.DB) func(http.Handler) http.Handler {
+	requireUser := RequireUser(env, db)
+	return func(next http.Handler) http.Handler {
+		return requireUser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if CurrentUser(r).Role != RoleAdmin {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}))
+	}
+}
+
+func redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("HX-Request") == "true" {
+		w.Header().Set("HX-Redirect", basepath.URL(r.Context(), "/login"))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method == http.MethodGet {
+		Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, env *Env, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     basepath.URL(r.Context(), "/"),
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   env.Auth.SecureCookies || isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func LoginPage(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving login")
+		count, err := CountUsers(db)
+		if err != nil {
+			http.Error(w, "Unable to load users", http.StatusInternalServerError)
+			return
+		}
+		// Without single sign-on the first account has to be registered
+		if count == 0 && env.Auth.OIDC.Issuer == "" {
+			Redirect(w, r, "/register", http.StatusSeeOther)
+			return
+		}
+		templ.Handler(ui.LoginPage("", env.Auth.AllowSignup, ssoLabel(env))).ServeHTTP(w, r)
+	})
+}
+
+func Login(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving login")
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Unable to parse form", http.StatusBadRequest)
+			return
+		}
+
+		user, err := Authenticate(db, env, r.FormValue("username"), r.FormValue("password"))
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			templ.Handler(ui.LoginPage(ErrInvalidCredentials.Error(), env.Auth.AllowSignup, ssoLabel(env))).ServeHTTP(w, r)
+			return
+		}
+
+		startSession(w, r, env, db, user)
+	})
+}
+
+// ssoLabel is the text of the single sign-on button, empty when disabled.
+func ssoLabel(env *Env) string {
+	if env.Auth.OIDC.Issuer == "" {
+		return ""
+	}
+	return env.Auth.OIDC.ButtonLabel
+}
+
+func Logout(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(sessionCookie); err == nil {
+			if err := DeleteSession(db, cookie.Value); err != nil {
+				env.Logger.ErrorContext(r.Context(), "Error deleting session", "err", err)
+			}
+		}
+		setSessionCookie(w, r, env, "", time.Unix(0, 0))
+		Redirect(w, r, "/login", http.StatusSeeOther)
+	})
+}
+
+func RegisterPage(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving register")
+		if !canRegister(w, env, db) {
+			return
+		}
+		templ.Handler(ui.RegisterPage("")).ServeHTTP(w, r)
+	})
+}
+
+func Register(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving register")
+		if !canRegister(w, env, db) {
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Unable to parse form", http.StatusBadRequest)
+			return
+		}
+
+		if r.FormValue("password") != r.FormValue("confirm") {
+			w.WriteHeader(http.StatusBadRequest)
+			templ.Handler(ui.RegisterPage("Passwords do not match")).ServeHTTP(w, r)
+			return
+		}
+
+		user, err := CreateUser(db, env, r.FormValue("username"), r.FormValue("password"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			templ.Handler(ui.RegisterPage(err.Error())).ServeHTTP(w, r)
+			return
+		}
+
+		startSession(w, r, env, db, user)
+	})
+}
+
+// canRegister allows sign ups while no account exists or when enabled.
+func canRegister(w http.ResponseWriter, env *Env, db *db.DB) bool {
+	count, err := CountUsers(db)
+	if err != nil {
+		http.Error(w, "Unable to load users", http.StatusInternalServerError)
+		return false
+	}
+	if count > 0 && !env.Auth.AllowSignup {
+		http.Error(w, "Registration is disabled", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func startSession(w http.ResponseWriter, r *http.Request, env *Env, db *db.DB, user User) {
+	logging.SetUser(r.Context(), user.Username)
+	token, expires, err := CreateSession(db, env, user.ID)
+	if err != nil {
+		http.Error(w, "Unable to start session", http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, r, env, token, expires)
+	Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,391 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/a-h/templ"
+
+	ui "github.com/parthshahp/booknotes/components"
+	"github.com/parthshahp/booknotes/internal/db"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+// bookAuthorsSQL selects the names of the authors of the book aliased as b
+// as a JSON array, in the order they were added. Names may hold commas, as
+// in "Tolkien, J.R.R.", so they can't be joined into one string.
+const bookAuthorsSQL = `(SELECT json_group_array(a.name ORDER BY ba.rowid)
+      FROM book_authors ba JOIN authors a ON ba.author_id = a.id WHERE ba.book_id = b.id)`
+
+var (
+	ErrAuthorName = errors.New("author name can't be empty")
+	ErrSameAuthor = errors.New("can't merge an author into itself")
+)
+
+// decodeNames reads a JSON array of names, as selected by bookAuthorsSQL.
+func decodeNames(column string) ([]string, error) {
+	var names []string
+	if err := json.Unmarshal([]byte(column), &names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+const authorsQuery = `
+  SELECT a.id, COALESCE(a.name, ''), COUNT(DISTINCT b.id), COUNT(e.id)
+  FROM authors a
+  JOIN book_authors ba ON ba.author_id = a.id
+  JOIN books b ON ba.book_id = b.id
+  LEFT JOIN entries e ON e.book_id = b.id
+  WHERE b.user_id = ? `
+
+// GetAuthors returns the authors of the user's books by name. Authors are
+// shared between users, so only the user's own books are counted.
+func GetAuthors(db *db.DB, env *Env, userID int) ([]Author, error) {
+	rows, err := db.Query(authorsQuery+`GROUP BY a.id ORDER BY a.name COLLATE NOCASE, a.id;`, userID)
+	if err != nil {
+		env.Logger.Error("Failed to query authors", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var authors []Author
+	for rows.Next() {
+		var author Author
+		if err := rows.Scan(&author.ID, &author.Name, &author.BookCount, &author.EntryCount); err != nil {
+			env.Logger.Error("Failed to scan author", "err", err)
+			return nil, err
+		}
+		authors = append(authors, author)
+	}
+	return authors, rows.Err()
+}
+
+// GetAuthor returns sql.ErrNoRows for authors none of the user's books
+// credit.
+func GetAuthor(db *db.DB, env *Env, userID int, authorID string) (Author, error) {
+	var author Author
+	err := db.QueryRow(authorsQuery+`AND a.id = ? GROUP BY a.id;`, userID, authorID).
+		Scan(&author.ID, &author.Name, &author.BookCount, &author.EntryCount)
+	if err != nil && err != sql.ErrNoRows {
+		env.Logger.Error("Failed to query author", "err", err)
+	}
+	return author, err
+}
+
+// GetAuthorBooks returns the user's books crediting the author by title.
+func GetAuthorBooks(db *db.DB, env *Env, userID int, authorID int) ([]Book, error) {
+	rows, err := db.Query(`
+  SELECT
+    b.id,
+    COALESCE(b.created_on, 0),
+    COALESCE(b.number_of_pages, 0),
+    COALESCE(b.title, ''),
+    `+bookAuthorsSQL+`,
+    (SELECT COUNT(*) FROM entries e WHERE e.book_id = b.id),
+    COALESCE((SELECT MAX(e.time) FROM entries e WHERE e.book_id = b.id), 0)
+  FROM books b
+  JOIN book_authors ba ON ba.book_id = b.id
+  WHERE ba.author_id = ? AND b.user_id = ?
+  ORDER BY b.title COLLATE NOCASE, b.id;
+  `, authorID, userID)
+	if err != nil {
+		env.Logger.Error("Failed to query author books", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var books []Book
+	for rows.Next() {
+		var book Book
+		var createdOn, lastEntryOn int64
+		var authors string
+		if err := rows.Scan(&book.ID, &createdOn, &book.NumberOfPages, &book.Title, &authors,
+			&book.EntryCount, &lastEntryOn); err != nil {
+			env.Logger.Error("Failed to scan book", "err", err)
+			return nil, err
+		}
+		if book.Authors, err = decodeNames(authors); err != nil {
+			return nil, err
+		}
+		book.TimeCreatedOn = time.Unix(createdOn, 0)
+		if lastEntryOn != 0 {
+			book.LastEntryOn = time.Unix(lastEntryOn, 0)
+		}
+		books = append(books, book)
+	}
+	return books, rows.Err()
+}
+
+// GetAuthorHighlights returns the highlights in the user's books crediting
+// the author, book by book in reading order.
+func GetAuthorHighlights(db *db.DB, env *Env, userID int, authorID int) ([]BookEntry, error) {
+	rows, err := db.Query(`
+    SELECT e.id, e.time, e.page, COALESCE(e.chapter, ''), COALESCE(e.text, ''), COALESCE(e.note, ''),
+      b.id, COALESCE(b.title, '')
+    FROM entries e
+    JOIN books b ON e.book_id = b.id
+    JOIN book_authors ba ON ba.book_id = b.id
+    WHERE ba.author_id = ? AND b.user_id = ?
+    ORDER BY b.title COLLATE NOCASE, b.id, e.page, e.time;
+  `, authorID, userID)
+	if err != nil {
+		env.Logger.Error("Failed to query entries", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []BookEntry
+	for rows.Next() {
+		var entry BookEntry
+		if err := rows.Scan(&entry.ID, &entry.Time, &entry.Page, &entry.Chapter, &entry.Text, &entry.Note,
+			&entry.BookID, &entry.BookTitle); err != nil {
+			env.Logger.Error("Failed to scan entry", "err", err)
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// RenameAuthor renames the author on the user's books and returns the id
+// the books credit afterwards. Renaming to the name of another author
+// merges the two. An author other users' books also credit is left alone
+// for them and the user's books move to an author with the new name.
+func RenameAuthor(db *db.DB, env *Env, userID int, authorID int, name string) (int, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return 0, ErrAuthorName
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var intoID int
+	err = tx.QueryRow(`SELECT id FROM authors WHERE name = ?;`, name).Scan(&intoID)
+	if err == nil && intoID == authorID {
+		return authorID, nil
+	}
+	if err == sql.ErrNoRows {
+		var shared bool
+		err = tx.QueryRow(`
+      SELECT EXISTS (
+        SELECT 1 FROM book_authors ba
+        JOIN books b ON ba.book_id = b.id
+        WHERE ba.author_id = ? AND b.user_id != ?);
+    `, authorID, userID).Scan(&shared)
+		if err != nil {
+			return 0, err
+		}
+		if !shared {
+			if _, err := tx.Exec(`UPDATE authors SET name = ? WHERE id = ?;`, name, authorID); err != nil {
+				return 0, err
+			}
+			return authorID, tx.Commit()
+		}
+
+		res, err := tx.Exec(`INSERT INTO authors (name) VALUES (?);`, name)
+		if err != nil {
+			return 0, err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		intoID = int(id)
+	} else if err != nil {
+		return 0, err
+	}
+
+	if err := moveAuthorBooks(tx, userID, authorID, intoID); err != nil {
+		return 0, err
+	}
+	return intoID, tx.Commit()
+}
+
+// MergeAuthors credits the author into on the user's books that credit
+// the author from, such as "J. R. R. Tolkien" and "J.R.R. Tolkien". Both
+// must be authors of the user's books.
+func MergeAuthors(db *db.DB, env *Env, userID int, fromID, intoID int) error {
+	if fromID == intoID {
+		return ErrSameAuthor
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var found int
+	err = tx.QueryRow(`
+    SELECT COUNT(DISTINCT ba.author_id) FROM book_authors ba
+    JOIN books b ON ba.book_id = b.id
+    WHERE ba.author_id IN (?, ?) AND b.user_id = ?;
+  `, fromID, intoID, userID).Scan(&found)
+	if err != nil {
+		return err
+	}
+	if found != 2 {
+		return sql.ErrNoRows
+	}
+
+	if err := moveAuthorBooks(tx, userID, fromID, intoID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// moveAuthorBooks credits into instead of from on the user's books,
+// keeping each book's author order, and deletes from once no book credits
+// it any more.
+func moveAuthorBooks(tx *sql.Tx, userID int, fromID, intoID int) error {
+	for _, stmt := range []struct {
+		query string
+		args  []any
+	}{
+		// Books crediting both keep into where it already is
+		{`UPDATE book_authors SET author_id = ?
+      WHERE author_id = ? AND book_id IN (SELECT id FROM books WHERE user_id = ?)
+      AND NOT EXISTS (
+        SELECT 1 FROM book_authors x WHERE x.book_id = book_authors.book_id AND x.author_id = ?);`,
+			[]any{intoID, fromID, userID, intoID}},
+		{`DELETE FROM book_authors
+      WHERE author_id = ? AND book_id IN (SELECT id FROM books WHERE user_id = ?);`,
+			[]any{fromID, userID}},
+		{`DELETE FROM authors
+      WHERE id = ? AND NOT EXISTS (SELECT 1 FROM book_authors WHERE author_id = ?);`,
+			[]any{fromID, fromID}},
+	} {
+		if _, err := tx.Exec(stmt.query, stmt.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func AuthorsPage(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving authors")
+		authors, err := GetAuthors(db, env, CurrentUser(r).ID)
+		if err != nil {
+			http.Error(w, "Unable to load authors", http.StatusInternalServerError)
+			return
+		}
+		templ.Handler(ui.AuthorsPage(authors)).ServeHTTP(w, r)
+	})
+}
+
+func AuthorPage(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorID := r.PathValue("id")
+		env.Logger.DebugContext(r.Context(), "Serving author", "author", authorID)
+		renderAuthorPage(w, r, env, db, authorID, "")
+	})
+}
+
+// EditAuthor renames an author, answering with the page of the author the
+// books credit afterwards.
+func EditAuthor(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving edit author")
+		author, ok := pathAuthor(w, r, env, db)
+		if !ok {
+			return
+		}
+
+		id, err := RenameAuthor(db, env, CurrentUser(r).ID, author.ID, r.FormValue("name"))
+		if err == ErrAuthorName {
+			renderAuthorPage(w, r, env, db, strconv.Itoa(author.ID), err.Error())
+			return
+		}
+		if err != nil {
+			http.Error(w, "Unable to rename author", http.StatusInternalServerError)
+			env.Logger.ErrorContext(r.Context(), "Error renaming author", "err", err)
+			return
+		}
+		renderAuthorPage(w, r, env, db, strconv.Itoa(id), "")
+	})
+}
+
+// MergeAuthor merges the author into the one picked in the form, answering
+// with the page of the one that remains.
+func MergeAuthor(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving merge author")
+		author, ok := pathAuthor(w, r, env, db)
+		if !ok {
+			return
+		}
+		intoID, err := strconv.Atoi(r.FormValue("into"))
+		if err != nil {
+			renderAuthorPage(w, r, env, db, strconv.Itoa(author.ID), "Pick an author to merge into")
+			return
+		}
+
+		err = MergeAuthors(db, env, CurrentUser(r).ID, author.ID, intoID)
+		if err == ErrSameAuthor {
+			renderAuthorPage(w, r, env, db, strconv.Itoa(author.ID), err.Error())
+			return
+		}
+		if err == sql.ErrNoRows {
+			http.Error(w, "Author not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Unable to merge authors", http.StatusInternalServerError)
+			env.Logger.ErrorContext(r.Context(), "Error merging authors", "err", err)
+			return
+		}
+		renderAuthorPage(w, r, env, db, strconv.Itoa(intoID), "")
+	})
+}
+
+// pathAuthor loads the author named by the path, answering with an error
+// itself when it can't.
+func pathAuthor(w http.ResponseWriter, r *http.Request, env *Env, db *db.DB) (Author, bool) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		env.Logger.ErrorContext(r.Context(), "Error parsing form", "err", err)
+		return Author{}, false
+	}
+	author, err := GetAuthor(db, env, CurrentUser(r).ID, r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Author not found", http.StatusNotFound)
+		return author, false
+	}
+	return author, true
+}
+
+func renderAuthorPage(w http.ResponseWriter, r *http.Request, env *Env, db *db.DB, authorID, errMsg string) {
+	user := CurrentUser(r)
+	author, err := GetAuthor(db, env, user.ID, authorID)
+	if err != nil {
+		http.Error(w, "Author not found", http.StatusNotFound)
+		return
+	}
+	books, err := GetAuthorBooks(db, env, user.ID, author.ID)
+	if err != nil {
+		http.Error(w, "Unable to load books", http.StatusInternalServerError)
+		return
+	}
+	entries, err := GetAuthorHighlights(db, env, user.ID, author.ID)
+	if err != nil {
+		http.Error(w, "Unable to load highlights", http.StatusInternalServerError)
+		return
+	}
+	authors, err := GetAuthors(db, env, user.ID)
+	if err != nil {
+		http.Error(w, "Unable to load authors", http.StatusInternalServerError)
+		return
+	}
+	templ.Handler(ui.AuthorPage(author, books, entries, authors, errMsg)).ServeHTTP(w, r)
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/a-h/templ"
+
+	ui "github.com/parthshahp/booknotes/components"
+	"github.com/parthshahp/booknotes/internal/backup"
+	"github.com/parthshahp/booknotes/internal/db"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+func BackupJson(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving backup json")
+		dump, err := db.Dump()
+		if err != nil {
+			http.Error(w, "Unable to read database", http.StatusInternalServerError)
+			env.Logger.ErrorContext(r.Context(), "Error dumping database", "err", err)
+			return
+		}
+
+		name := "booknotes-backup-" + time.Now().Format("2006-01-02")
+		w.Header().Set("Content-Disposition", ContentDisposition(name, ".json"))
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(dump); err != nil {
+			env.Logger.ErrorContext(r.Context(), "Error writing backup", "err", err)
+		}
+	})
+}
+
+// RestoreJson restores a backup sent either as the raw request body or as
+// the "file" field of a multipart form. ?mode=replace wipes the library
+// first, the default mode merges into it.
+func RestoreJson(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving restore json")
+
+		mode := r.URL.Query().Get("mode")
+
+		var body io.Reader = r.Body
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				http.Error(w, "No file uploaded", http.StatusBadRequest)
+				env.Logger.ErrorContext(r.Context(), "Error reading uploaded backup", "err", err)
+				return
+			}
+			defer file.Close()
+			body = file
+
+			if mode == "" {
+				mode = r.FormValue("mode")
+			}
+		}
+
+		if mode != "" && mode != "merge" && mode != "replace" {
+			http.Error(w, "Unknown restore mode", http.StatusBadRequest)
+			return
+		}
+
+		dump, err := decodeDump(body)
+		if err != nil {
+			http.Error(w, "Unable to parse json", http.StatusBadRequest)
+			env.Logger.ErrorContext(r.Context(), "Error parsing backup", "err", err)
+			return
+		}
+
+		if err := db.Restore(dump, mode == "replace", int64(CurrentUser(r).ID)); err != nil {
+			http.Error(w, "Unable to restore backup: "+err.Error(), http.StatusBadRequest)
+			env.Logger.ErrorContext(r.Context(), "Error restoring backup", "err", err)
+			return
+		}
+
+		env.Logger.InfoContext(r.Context(), "Restored backup", "books", len(dump.Books))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Backup restored successfully"))
+	})
+}
+
+func decodeDump(r io.Reader) (*db.Dump, error) {
+	var dump db.Dump
+	if err := json.NewDecoder(r).Decode(&dump); err != nil {
+		return nil, err
+	}
+	return &dump, nil
+}
+
+func BackupsPage(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving backups")
+		renderBackups(w, r, env, "")
+	})
+}
+
+func CreateBackup(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving create backup")
+		message := ""
+		snapshot, err := backup.Create(db, env)
+		if err != nil {
+			env.Logger.ErrorContext(r.Context(), "Error creating backup", "err", err)
+			message = "Backup failed: " + err.Error()
+		} else {
+			message = "Created " + snapshot.Name
+		}
+		renderBackups(w, r, env, message)
+	})
+}
+
+func DownloadBackup(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving download backup")
+		snapshot, err := backup.Find(env.Backup.Dir, r.PathValue("name"))
+		if err != nil {
+			http.Error(w, "Backup not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Disposition", ContentDisposition(strings.TrimSuffix(snapshot.Name, ".db"), ".db"))
+		w.Header().Set("Content-Type", "application/vnd.sqlite3")
+		http.ServeFile(w, r, snapshot.Path)
+	})
+}
+
+func VerifyBackup(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving verify backup")
+		snapshot, err := backup.Find(env.Backup.Dir, r.PathValue("name"))
+		if err != nil {
+			http.Error(w, "Backup not found", http.StatusNotFound)
+			return
+		}
+
+		message := snapshot.Name + " passed the integrity check"
+		if err := backup.CheckIntegrity(snapshot.Path); err != nil {
+			message = err.Error()
+		}
+		renderBackups(w, r, env, message)
+	})
+}
+
+func RestoreBackup(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving restore backup")
+		name := r.PathValue("name")
+		message := "Restored " + name
+		if err := backup.Restore(db, env, name, int64(CurrentUser(r).ID)); err != nil {
+			env.Logger.ErrorContext(r.Context(), "Error restoring backup", "err", err)
+			message = "Restore failed: " + err.Error()
+		}
+		renderBackups(w, r, env, message)
+	})
+}
+
+func renderBackups(w http.ResponseWriter, r *http.Request, env *Env, message string) {
+	snapshots, err := backup.List(env.Backup.Dir)
+	if err != nil {
+		http.Error(w, "Unable to list backups", http.StatusInternalServerError)
+		env.Logger.Error("Error listing backups", "err", err)
+		return
+	}
+	templ.Handler(ui.BackupsPage(snapshots, env.Backup, message)).ServeHTTP(w, r)
+}
@@ -0,0 +1,308 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parthshahp/booknotes/internal/basepath"
+	"github.com/parthshahp/booknotes/internal/db"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+// bookPageSize is how many books the table shows at once.
+const bookPageSize = 50
+
+// ErrInvalidCursor is returned for an after cursor that doesn't belong to
+// the query's sort column.
+var ErrInvalidCursor = errors.New("invalid page cursor")
+
+// bookSortKey is the SQL expression, on books aliased as b, a column of the
+// book table sorts on. Text keys compare case-insensitively.
+type bookSortKey struct {
+	expr string
+	text bool
+}
+
+var bookSortKeys = map[string]bookSortKey{
+	SortTitle: {`COALESCE(b.title, '')`, true},
+	SortAuthor: {`COALESCE((SELECT MIN(a.name) FROM book_authors ba
+      JOIN authors a ON ba.author_id = a.id WHERE ba.book_id = b.id), '')`, true},
+	SortHighlights: {`(SELECT COUNT(*) FROM entries e WHERE e.book_id = b.id)`, false},
+	SortCreated:    {`COALESCE(b.created_on, 0)`, false},
+	SortLastEntry:  {`COALESCE((SELECT MAX(e.time) FROM entries e WHERE e.book_id = b.id), 0)`, false},
+}
+
+// ParseBookQuery reads the book table's state from a query string: q,
+// author, collection, tag, from, to, sort, order and after.
+func ParseBookQuery(query url.Values) (BookQuery, error) {
+	q := DefaultBookQuery()
+	q.Search = strings.TrimSpace(query.Get("q"))
+	q.Author = query.Get("author")
+	q.Collection = query.Get("collection")
+	q.Tag = query.Get("tag")
+	q.From = query.Get("from")
+	q.To = query.Get("to")
+	q.After = query.Get("after")
+
+	if _, err := ParseLibraryFilter(query); err != nil {
+		return q, err
+	}
+	if sort := query.Get("sort"); sort != "" {
+		if _, ok := bookSortKeys[sort]; !ok {
+			return q, fmt.Errorf("unknown sort %q", sort)
+		}
+		q.Sort = sort
+		// Text columns read A to Z unless told otherwise
+		q.Desc = sort != SortTitle && sort != SortAuthor
+	}
+	switch order := query.Get("order"); order {
+	case "":
+	case SortAscending:
+		q.Desc = false
+	case SortDescending:
+		q.Desc = true
+	default:
+		return q, fmt.Errorf("unknown order %q", order)
+	}
+	return q, nil
+}
+
+// GetBookPage returns the page of the user's books q asks for. Pages are
+// found by keyset rather than offset: the cursor holds the sort key and id
+// of the last book on the previous page, so a page stays put when books
+// are added or removed ahead of it.
+func GetBookPage(db *db.DB, env *Env, userID int, q BookQuery) (BookPage, error) {
+	page := BookPage{Query: q}
+	key, ok := bookSortKeys[q.Sort]
+	if !ok {
+		return page, fmt.Errorf("unknown sort %q", q.Sort)
+	}
+	filter, err := ParseLibraryFilter(url.Values{
+		"author": {q.Author}, "collection": {q.Collection}, "tag": {q.Tag}, "from": {q.From}, "to": {q.To},
+	})
+	if err != nil {
+		return page, err
+	}
+
+	conditions, args := filter.where(userID)
+	if q.Search != "" {
+		conditions = append(conditions, `(b.title LIKE ? OR EXISTS (
+      SELECT 1 FROM book_authors ba
+      JOIN authors a ON ba.author_id = a.id
+      WHERE ba.book_id = b.id AND a.name LIKE ?))`)
+		args = append(args, "%"+q.Search+"%", "%"+q.Search+"%")
+	}
+
+	sortKey, order, cmp := `sort_key`, `ASC`, `>`
+	if key.text {
+		sortKey += ` COLLATE NOCASE`
+	}
+	if q.Desc {
+		order, cmp = `DESC`, `<`
+	}
+	keyset := ``
+	if q.After != "" {
+		after, id, err := decodeCursor(q.After, key.text)
+		if err != nil {
+			return page, err
+		}
+		keyset = fmt.Sprintf(`WHERE %[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?)`, sortKey, cmp)
+		args = append(args, after, after, id)
+	}
+
+	query := `
+  SELECT id, created_on, number_of_pages, title, authors, tags, collections, entry_count, last_entry_on, md5, percentage, device, timestamp, sort_key
+  FROM (
+    SELECT
+      b.id,
+      COALESCE(b.created_on, 0) AS created_on,
+      COALESCE(b.number_of_pages, 0) AS number_of_pages,
+      COALESCE(b.title, '') AS title,
+      ` + bookAuthorsSQL + ` AS authors,
+      ` + tagLabels.selectSQL() + ` AS tags,
+      ` + collectionLabels.selectSQL() + ` AS collections,
+      (SELECT COUNT(*) FROM entries e WHERE e.book_id = b.id) AS entry_count,
+      COALESCE((SELECT MAX(e.time) FROM entries e WHERE e.book_id = b.id), 0) AS last_entry_on,
+      COALESCE(b.md5, '') AS md5,
+      COALESCE(p.percentage, 0) AS percentage,
+      COALESCE(p.device, '') AS device,
+      COALESCE(p.timestamp, 0) AS timestamp,
+      ` + key.expr + ` AS sort_key
+    FROM books b
+    LEFT JOIN
+      kosync_progress p ON p.user_id = b.user_id AND p.document = b.md5
+    WHERE ` + strings.Join(conditions, ` AND `) + `
+  )
+  ` + keyset + `
+  ORDER BY ` + sortKey + ` ` + order + `, id ` + order + `
+  LIMIT ?;
+  `
+	// One more than a page tells whether there is a next one
+	args = append(args, bookPageSize+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		env.Logger.Error("Failed to query books", "err", err)
+		return page, err
+	}
+	defer rows.Close()
+
+	var lastKey any
+	for rows.Next() {
+		var book Book
+		var createdOn, lastEntryOn, progressOn int64
+		var authors, tags, collections string
+		var sortValue any
+		if err := rows.Scan(&book.ID, &createdOn, &book.NumberOfPages, &book.Title, &authors, &tags, &collections, &book.EntryCount,
+			&lastEntryOn, &book.MD5, &book.Progress.Percentage, &book.Progress.Device, &progressOn, &sortValue); err != nil {
+			env.Logger.Error("Failed to scan book", "err", err)
+			return page, err
+		}
+		if len(page.Books) == bookPageSize {
+			page.Next = encodeCursor(lastKey, page.Books[len(page.Books)-1].ID)
+			break
+		}
+
+		book.TimeCreatedOn = time.Unix(createdOn, 0)
+		if book.Authors, err = decodeNames(authors); err != nil {
+			return page, err
+		}
+		if book.Tags, err = decodeNames(tags); err != nil {
+			return page, err
+		}
+		if book.Collections, err = decodeNames(collections); err != nil {
+			return page, err
+		}
+		if lastEntryOn != 0 {
+			book.LastEntryOn = time.Unix(lastEntryOn, 0)
+		}
+		if progressOn != 0 {
+			book.Progress.UpdatedOn = time.Unix(progressOn, 0)
+		}
+		page.Books = append(page.Books, book)
+		lastKey = sortValue
+	}
+	if err := rows.Err(); err != nil {
+		env.Logger.Error("Failed to read books", "err", err)
+		return page, err
+	}
+
+	page.Authors, page.Collections, page.Tags, err = getBookFilterOptions(db, userID)
+	if err != nil {
+		env.Logger.Error("Failed to query book filters", "err", err)
+		return page, err
+	}
+	return page, nil
+}
+
+// getBookFilterOptions lists the authors, collections and tags the user's
+// books can be filtered by.
+func getBookFilterOptions(db *db.DB, userID int) (authors, collections, tags []string, err error) {
+	lists := []struct {
+		dst   *[]string
+		query string
+	}{
+		{&authors, `
+      SELECT DISTINCT a.name FROM authors a
+      JOIN book_authors ba ON ba.author_id = a.id
+      JOIN books b ON ba.book_id = b.id
+      WHERE b.user_id = ? AND a.name != ''
+      ORDER BY a.name COLLATE NOCASE;`},
+		{&collections, `SELECT name FROM collections WHERE user_id = ? ORDER BY name COLLATE NOCASE;`},
+		{&tags, `SELECT name FROM tags WHERE user_id = ? ORDER BY name COLLATE NOCASE;`},
+	}
+	for _, list := range lists {
+		if *list.dst, err = queryStrings(db, list.query, userID); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return authors, collections, tags, nil
+}
+
+func queryStrings(db *db.DB, query string, args ...any) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// encodeCursor packs a sort key and book id as "id:key" in URL-safe base64.
+func encodeCursor(key any, id int) string {
+	var s string
+	switch key := key.(type) {
+	case []byte:
+		s = string(key)
+	default:
+		s = fmt.Sprint(key)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(id) + ":" + s))
+}
+
+func decodeCursor(cursor string, text bool) (key any, id int, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, 0, ErrInvalidCursor
+	}
+	idPart, keyPart, ok := strings.Cut(string(data), ":")
+	if !ok {
+		return nil, 0, ErrInvalidCursor
+	}
+	if id, err = strconv.Atoi(idPart); err != nil {
+		return nil, 0, ErrInvalidCursor
+	}
+	if text {
+		return keyPart, id, nil
+	}
+	n, err := strconv.ParseInt(keyPart, 10, 64)
+	if err != nil {
+		return nil, 0, ErrInvalidCursor
+	}
+	return n, id, nil
+}
+
+// bookTableURL is the address of the page showing the table as q has it,
+// for the browser's history.
+func bookTableURL(r *http.Request, q BookQuery) string {
+	location := basepath.URL(r.Context(), "/")
+	if values := q.Values(); len(values) > 0 {
+		location += "?" + values.Encode()
+	}
+	return location
+}
+
+// loadBookPage reads the table's state from the request and loads the page,
+// answering with an error itself when it fails.
+func loadBookPage(w http.ResponseWriter, r *http.Request, env *Env, db *db.DB) (BookPage, bool) {
+	q, err := ParseBookQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return BookPage{}, false
+	}
+	page, err := GetBookPage(db, env, CurrentUser(r).ID, q)
+	if err == ErrInvalidCursor {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return page, false
+	}
+	if err != nil {
+		http.Error(w, "Unable to load books", http.StatusInternalServerError)
+		env.Logger.ErrorContext(r.Context(), "Error loading books", "err", err)
+		return page, false
+	}
+	return page, true
+}
@@ -2,33 +2,35 @@ package api
 
 import (
 	"database/sql"
-	"log"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/parthshahp/booknotes/internal/db"
 	. "github.com/parthshahp/booknotes/internal/types"
 )
 
-func GetBook(db *db.DB, env *Env, bookID string) Book {
+func GetBook(db *db.DB, env *Env, userID int, bookID string) (Book, error) {
 	query := `
   SELECT 
     b.id, 
     b.created_on,
     b.number_of_pages,
     b.title, 
-    a.authors,
-    COUNT(e.id) AS entry_count
+    ` + bookAuthorsSQL + `,
+    ` + tagLabels.selectSQL() + `,
+    ` + collectionLabels.selectSQL() + `,
+    COUNT(e.id) AS entry_count,
+    COALESCE(MAX(e.time), 0),
+    COALESCE(b.md5, ''),
+    COALESCE(p.percentage, 0),
+    COALESCE(p.device, ''),
+    COALESCE(p.timestamp, 0)
   FROM books b
-  LEFT JOIN
-    (SELECT ba.book_id, GROUP_CONCAT(a.name) AS authors
-    FROM book_authors ba
-    JOIN authors a ON ba.author_id = a.id
-    GROUP BY ba.book_id) a ON b.id = a.book_id
   LEFT JOIN
     entries e ON b.id = e.book_id
-  WHERE b.id = ?
+  LEFT JOIN
+    kosync_progress p ON p.user_id = b.user_id AND p.document = b.md5
+  WHERE b.id = ? AND b.user_id = ?
   GROUP BY b.id
   ORDER BY b.created_on DESC;
   `
@@ -37,16 +39,33 @@ func GetBook(db *db.DB, env *Env, bookID string) Book {
 	var createdOn int64
 	var numberOfPages int
 	var title string
-	var authors string
+	var authors, tags, collections string
 	var entryCount int
-	err := db.QueryRow(query, bookID).
-		Scan(&id, &createdOn, &numberOfPages, &title, &authors, &entryCount)
+	var lastEntryOn int64
+	var md5 string
+	var progress ReadingProgress
+	var progressOn int64
+	err := db.QueryRow(query, bookID, userID).
+		Scan(&id, &createdOn, &numberOfPages, &title, &authors, &tags, &collections, &entryCount, &lastEntryOn,
+			&md5, &progress.Percentage, &progress.Device, &progressOn)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			env.Logger.Error("Failed to query book", "err", err)
+		}
+		return Book{}, err
+	}
+	authorList, err := decodeNames(authors)
 	if err != nil {
-		env.ErrorLog.Fatalf("Failed to query book: %s", err)
+		return Book{}, err
+	}
+	tagList, err := decodeNames(tags)
+	if err != nil {
+		return Book{}, err
+	}
+	collectionList, err := decodeNames(collections)
+	if err != nil {
+		return Book{}, err
 	}
-	authorList := strings.Split(authors, ",")
-
-	env.InfoLog.Println(authors)
 
 	book := Book{
 		ID:            id,
@@ -55,12 +74,22 @@ func GetBook(db *db.DB, env *Env, bookID string) Book {
 		Title:         title,
 		EntryCount:    entryCount,
 		Authors:       authorList,
+		Tags:          tagList,
+		Collections:   collectionList,
+		MD5:           md5,
+		Progress:      progress,
+	}
+	if lastEntryOn != 0 {
+		book.LastEntryOn = time.Unix(lastEntryOn, 0)
+	}
+	if progressOn != 0 {
+		book.Progress.UpdatedOn = time.Unix(progressOn, 0)
 	}
-	return book
+	return book, nil
 }
 
-func GetAllBooks(db *db.DB, env *Env, search string) []Book {
-	env.InfoLog.Println("Getting all books")
+func GetAllBooks(db *db.DB, env *Env, userID int, search string) ([]Book, error) {
+	env.Logger.Debug("Getting all books")
 	var rows *sql.Rows
 	var err error
 
@@ -72,23 +101,26 @@ func GetAllBooks(db *db.DB, env *Env, search string) []Book {
         b.created_on,
         b.number_of_pages,
         b.title, 
-        a.authors,
-        COUNT(e.id) AS entry_count
+        ` + bookAuthorsSQL + `,
+        COUNT(e.id) AS entry_count,
+        COALESCE(b.md5, ''),
+        COALESCE(p.percentage, 0),
+        COALESCE(p.device, ''),
+        COALESCE(p.timestamp, 0)
       FROM books b
-      LEFT JOIN
-        (SELECT ba.book_id, GROUP_CONCAT(a.name) AS authors
-        FROM book_authors ba
-        JOIN authors a ON ba.author_id = a.id
-        GROUP BY ba.book_id) a ON b.id = a.book_id
       LEFT JOIN
         entries e ON b.id = e.book_id
+      LEFT JOIN
+        kosync_progress p ON p.user_id = b.user_id AND p.document = b.md5
+      WHERE b.user_id = ?
       GROUP BY b.id
       ORDER BY b.created_on DESC;
     `
 
-		rows, err = db.Query(query)
+		rows, err = db.Query(query, userID)
 		if err != nil {
-			log.Fatalf("Failed to query books: %s", err)
+			env.Logger.Error("Failed to query books", "err", err)
+			return nil, err
 		}
 	} else {
 
@@ -98,24 +130,29 @@ func GetAllBooks(db *db.DB, env *Env, search string) []Book {
         b.created_on,
         b.number_of_pages,
         b.title, 
-        a.authors,
-        COUNT(e.id) AS entry_count
+        ` + bookAuthorsSQL + `,
+        COUNT(e.id) AS entry_count,
+        COALESCE(b.md5, ''),
+        COALESCE(p.percentage, 0),
+        COALESCE(p.device, ''),
+        COALESCE(p.timestamp, 0)
       FROM books b
-      LEFT JOIN
-        (SELECT ba.book_id, GROUP_CONCAT(a.name) AS authors
-        FROM book_authors ba
-        JOIN authors a ON ba.author_id = a.id
-        GROUP BY ba.book_id) a ON b.id = a.book_id
       LEFT JOIN
         entries e ON b.id = e.book_id
-      WHERE b.title LIKE ? or a.authors LIKE ?
+      LEFT JOIN
+        kosync_progress p ON p.user_id = b.user_id AND p.document = b.md5
+      WHERE b.user_id = ? AND (b.title LIKE ? OR EXISTS (
+        SELECT 1 FROM book_authors ba
+        JOIN authors a ON ba.author_id = a.id
+        WHERE ba.book_id = b.id AND a.name LIKE ?))
       GROUP BY b.id
       ORDER BY b.created_on DESC;
     `
 
-		rows, err = db.Query(query, "%"+search+"%", "%"+search+"%")
+		rows, err = db.Query(query, userID, "%"+search+"%", "%"+search+"%")
 		if err != nil {
-			log.Fatalf("Failed to query books: %s", err)
+			env.Logger.Error("Failed to query books", "err", err)
+			return nil, err
 		}
 	}
 	defer rows.Close()
@@ -128,12 +165,20 @@ func GetAllBooks(db *db.DB, env *Env, search string) []Book {
 		var title string
 		var authors string
 		var entryCount int
+		var md5 string
+		var progress ReadingProgress
+		var progressOn int64
 
-		if err := rows.Scan(&bookID, &createdOn, &numberOfPages, &title, &authors, &entryCount); err != nil {
-			log.Fatalf("Failed to scan book: %s", err)
+		if err := rows.Scan(&bookID, &createdOn, &numberOfPages, &title, &authors, &entryCount,
+			&md5, &progress.Percentage, &progress.Device, &progressOn); err != nil {
+			env.Logger.Error("Failed to scan book", "err", err)
+			return nil, err
 		}
 
-		authorList := strings.Split(authors, ",")
+		authorList, err := decodeNames(authors)
+		if err != nil {
+			return nil, err
+		}
 
 		book := Book{
 			ID:            bookID,
@@ -142,81 +187,134 @@ func GetAllBooks(db *db.DB, env *Env, search string) []Book {
 			Title:         title,
 			EntryCount:    entryCount,
 			Authors:       authorList,
+			MD5:           md5,
+			Progress:      progress,
+		}
+		if progressOn != 0 {
+			book.Progress.UpdatedOn = time.Unix(progressOn, 0)
 		}
 		books = append(books, book)
 	}
 
-	return books
+	return books, rows.Err()
 }
 
-func UpdateBook(db *db.DB, env *Env, title, id string, authors []string) {
-	query := `UPDATE books SET title = ? WHERE id = ?;`
-	stmt, err := db.Prepare(query)
+// UpdateBook sets the title and authors of the user's book. It returns
+// sql.ErrNoRows when the user has no such book.
+func UpdateBook(db *db.DB, env *Env, userID int, title, id string, authors []string) error {
+	tx, err := db.Begin()
 	if err != nil {
-		env.ErrorLog.Fatalf("Failed to prepare query: %s", err)
+		return err
 	}
-	defer stmt.Close()
+	defer tx.Rollback()
 
-	if _, err := stmt.Exec(title, id); err != nil {
-		env.ErrorLog.Fatalf("Failed to update book: %s", err)
+	res, err := tx.Exec(`UPDATE books SET title = ? WHERE id = ? AND user_id = ?;`, title, id, userID)
+	if err != nil {
+		env.Logger.Error("Failed to update book", "err", err)
+		return err
+	}
+	// Leave the authors alone when the book belongs to someone else
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
 	}
 
 	// Delete the original authors
-	query = `DELETE FROM book_authors WHERE book_id = ?;`
-	_, err = db.Exec(query, id)
-	if err != nil {
-		env.ErrorLog.Fatalf("Failed to delete authors: %s", err)
+	if _, err := tx.Exec(`DELETE FROM book_authors WHERE book_id = ?;`, id); err != nil {
+		env.Logger.Error("Failed to delete authors", "err", err)
+		return err
 	}
 
 	for _, author := range authors {
 		// Check if author already exists
 		var authorID int64
-		queryAuthor := `SELECT id FROM authors WHERE name = ?`
-		err = db.QueryRow(queryAuthor, author).Scan(&authorID)
-		if err != nil && err != sql.ErrNoRows {
-			env.ErrorLog.Fatalf("Failed to query author: %s", err)
-		}
-
+		err = tx.QueryRow(`SELECT id FROM authors WHERE name = ?`, author).Scan(&authorID)
 		if err == sql.ErrNoRows {
 			// Insert author if not exists
-			insertAuthor := `INSERT INTO authors (name) VALUES (?)`
-			res, err := db.Exec(insertAuthor, author)
+			res, err := tx.Exec(`INSERT INTO authors (name) VALUES (?)`, author)
 			if err != nil {
-				env.ErrorLog.Fatalf("Failed to insert author data: %s", err)
+				env.Logger.Error("Failed to insert author", "err", err)
+				return err
 			}
-
-			// Get the author_id of the inserted author
-			authorID, err = res.LastInsertId()
-			if err != nil {
-				env.ErrorLog.Fatalf("Failed to get last insert id: %s", err)
+			if authorID, err = res.LastInsertId(); err != nil {
+				return err
 			}
+		} else if err != nil {
+			env.Logger.Error("Failed to query author", "err", err)
+			return err
 		}
 
 		// Link book and author
-		insertBookAuthor := `INSERT INTO book_authors (book_id, author_id) VALUES (?, ?)`
-		if _, err := db.Exec(insertBookAuthor, id, authorID); err != nil {
-			env.ErrorLog.Fatalf("Failed to insert book_author data: %s", err)
+		if _, err := tx.Exec(`INSERT INTO book_authors (book_id, author_id) VALUES (?, ?)`, id, authorID); err != nil {
+			env.Logger.Error("Failed to link author", "err", err)
+			return err
 		}
 	}
+	return tx.Commit()
 }
 
-func AddImage(db *db.DB, env *Env, bookID string, imagePath string) {
-	imageBytes, err := os.ReadFile(imagePath)
+// RemoveBook deletes the user's book along with its highlights, image and
+// links. It returns sql.ErrNoRows when the user has no such book.
+func RemoveBook(db *db.DB, env *Env, userID int, id string) error {
+	tx, err := db.Begin()
 	if err != nil {
-		env.ErrorLog.Fatalf("Failed to read image file: %s", err)
+		return err
 	}
+	defer tx.Rollback()
 
-	query := `INSERT INTO book_images (book_id, image) VALUES (?, ?);`
-	_, err = db.Exec(query, bookID, imageBytes)
+	res, err := tx.Exec(`DELETE FROM books WHERE id = ? AND user_id = ?;`, id, userID)
+	if err != nil {
+		env.Logger.Error("Failed to delete book", "err", err)
+		return err
+	}
+	// Only clean up links of books that belonged to the user
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
+	}
+
+	for _, query := range []string{
+		`DELETE FROM book_authors WHERE book_id = ?;`,
+		`DELETE FROM entries WHERE book_id = ?;`,
+		`DELETE FROM book_images WHERE book_id = ?;`,
+		`DELETE FROM book_tags WHERE book_id = ?;`,
+		`DELETE FROM collection_books WHERE book_id = ?;`,
+		`DELETE FROM share_links WHERE book_id = ?;`,
+	} {
+		if _, err := tx.Exec(query, id); err != nil {
+			env.Logger.Error("Failed to delete book links", "err", err)
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-func RetrieveImage(db *db.DB, env *Env, bookID string) []byte {
-	var image []byte
-	query := `SELECT image FROM book_images WHERE book_id = ?;`
-	err := db.QueryRow(query, bookID).Scan(&image)
+func AddImage(db *db.DB, env *Env, userID int, bookID string, imagePath string) error {
+	imageBytes, err := os.ReadFile(imagePath)
 	if err != nil {
-		env.ErrorLog.Fatalf("Failed to query image: %s", err)
+		return err
 	}
 
-	return image
+	query := `
+  INSERT INTO book_images (book_id, image)
+  SELECT id, ? FROM books WHERE id = ? AND user_id = ?;
+  `
+	if _, err := db.Exec(query, imageBytes, bookID, userID); err != nil {
+		env.Logger.Error("Failed to insert image", "err", err)
+		return err
+	}
+	return nil
+}
+
+// RetrieveImage returns sql.ErrNoRows when the user's book has no image.
+func RetrieveImage(db *db.DB, env *Env, userID int, bookID string) ([]byte, error) {
+	var image []byte
+	query := `
+  SELECT i.image FROM book_images i
+  JOIN books b ON i.book_id = b.id
+  WHERE i.book_id = ? AND b.user_id = ?;
+  `
+	err := db.QueryRow(query, bookID, userID).Scan(&image)
+	if err != nil && err != sql.ErrNoRows {
+		env.Logger.Error("Failed to query image", "err", err)
+	}
+	return image, err
 }
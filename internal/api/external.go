@@ -1,9 +1,11 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -18,14 +20,14 @@ func ImportJson(env *Env, db *db.DB) http.HandlerFunc {
 
 		if err := json.NewDecoder(r.Body).Decode(&bookImport); err != nil {
 			http.Error(w, "Unable to parse json", http.StatusBadRequest)
-			env.ErrorLog.Println("Error parsing json:", err)
+			env.Logger.ErrorContext(r.Context(), "Error parsing json", "err", err)
 			return
 		}
 
-		err := InsertData(bookImport, db, env)
+		err := InsertData(bookImport, db, env, CurrentUser(r).ID)
 		if err != nil {
 			http.Error(w, "Unable to insert data", http.StatusBadRequest)
-			env.ErrorLog.Println("Error inserting data:", err)
+			env.Logger.ErrorContext(r.Context(), "Error inserting data", "err", err)
 			return
 		}
 
@@ -33,104 +35,295 @@ func ImportJson(env *Env, db *db.DB) http.HandlerFunc {
 	})
 }
 
+const (
+	OrderReading       = "reading"
+	OrderChronological = "chronological"
+	OrderReverse       = "reverse"
+
+	GroupChapter = "chapter"
+	GroupPage    = "page"
+	GroupNone    = "none"
+)
+
+// Whitelisted ORDER BY clauses for each order mode
+var exportOrders = map[string]string{
+	OrderReading:       "page ASC, time ASC, id ASC",
+	OrderChronological: "time ASC, id ASC",
+	OrderReverse:       "time DESC, id DESC",
+}
+
+type ExportOptions struct {
+	Order string
+	Group string
+}
+
+// ParseExportOptions reads the order and group modes from a query string,
+// defaulting to reading order grouped by chapter.
+func ParseExportOptions(query url.Values) (ExportOptions, error) {
+	opts := ExportOptions{Order: OrderReading, Group: GroupChapter}
+	if order := query.Get("order"); order != "" {
+		opts.Order = order
+	}
+	if group := query.Get("group"); group != "" {
+		opts.Group = group
+	}
+
+	if _, ok := exportOrders[opts.Order]; !ok {
+		return opts, fmt.Errorf("unknown order mode %q", opts.Order)
+	}
+	switch opts.Group {
+	case GroupChapter, GroupPage, GroupNone:
+	default:
+		return opts, fmt.Errorf("unknown group mode %q", opts.Group)
+	}
+
+	return opts, nil
+}
+
 func ExportMarkdown(env *Env, db *db.DB) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		env.InfoLog.Println("Serving export markdown")
+		env.Logger.DebugContext(r.Context(), "Serving export markdown")
 		id := r.PathValue("id")
 
-		// Get book from db
-		query := `
-      SELECT 
-        b.title, 
-        b.created_on AS book_time,
-        b.number_of_pages,
-        a.authors,
-        e.id AS entry_id,
-        e.time AS entry_time,
-        e.page,
-        e.chapter,
-        e.text,
-        e.note
-      FROM books b
-      LEFT JOIN
-        (SELECT ba.book_id, GROUP_CONCAT(a.name) AS authors
-        FROM book_authors ba
-        JOIN authors a ON ba.author_id = a.id
-        GROUP BY ba.book_id) a ON b.id = a.book_id
-      LEFT JOIN
-        entries e ON b.id = e.book_id
-      WHERE b.id = ?
-      ORDER BY e.time DESC;
-  `
+		opts, err := ParseExportOptions(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		rows, err := db.Query(query, id)
+		user := CurrentUser(r)
+		data, err := GetExportBook(db, env, user.ID, id, opts)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Book not found", http.StatusNotFound)
+			return
+		}
 		if err != nil {
-			env.ErrorLog.Fatalf("Failed to query books: %s", err)
-		}
-		defer rows.Close()
-
-		type mdNode struct {
-			title    string
-			bookTime int64
-			pages    int
-			authors  string
-			entry    Entry
-		}
-
-		mdNodeList := []mdNode{}
-
-		for rows.Next() {
-			curr := mdNode{}
-
-			err = rows.Scan(
-				&curr.title,
-				&curr.bookTime,
-				&curr.pages,
-				&curr.authors,
-				&curr.entry.ID,
-				&curr.entry.Time,
-				&curr.entry.Page,
-				&curr.entry.Chapter,
-				&curr.entry.Text,
-				&curr.entry.Note,
-			)
+			http.Error(w, "Unable to load book", http.StatusInternalServerError)
+			return
+		}
+
+		var result string
+		if name := r.URL.Query().Get("template"); name != "" {
+			// Render with a user-defined template
+			exportTemplate, err := GetExportTemplate(db, env, user.ID, name)
 			if err != nil {
-				env.ErrorLog.Fatalf("Failed to scan rows: %s", err)
+				http.Error(w, "Unknown export template", http.StatusNotFound)
+				return
 			}
 
-			mdNodeList = append(mdNodeList, curr)
-		}
-		// Conver to markdown format
-		markdownContent := []string{}
-		markdownContent = append(markdownContent, "# Title: "+mdNodeList[0].title)
-		markdownContent = append(markdownContent, "*Authors: "+mdNodeList[0].authors+"*")
-		markdownContent = append(
-			markdownContent,
-			"*Date: "+time.Unix(mdNodeList[0].bookTime, 0).Format("2006-01-02")+"*",
-		)
-		markdownContent = append(markdownContent, "")
-
-		for i, node := range mdNodeList {
-			if i == 0 || node.entry.Chapter != mdNodeList[i-1].entry.Chapter {
-				markdownContent = append(markdownContent, "## "+node.entry.Chapter)
+			result, err = RenderExportTemplate(exportTemplate.Name, exportTemplate.Body, data)
+			if err != nil {
+				http.Error(w, "Unable to render export template", http.StatusInternalServerError)
+				env.Logger.ErrorContext(r.Context(), "Error rendering export template", "err", err)
+				return
 			}
+		} else {
+			result = RenderMarkdown(data, opts)
+		}
+
+		// Export
+		w.Header().Set("Content-Disposition", ContentDisposition(data.Book.Title, ".md"))
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Write([]byte(result))
+	})
+}
+
+// GetExportBook loads a book and its highlights into the export data model,
+// ordering and grouping the highlights according to opts. It returns
+// sql.ErrNoRows when the book does not exist.
+func GetExportBook(db *db.DB, env *Env, userID int, bookID string, opts ExportOptions) (ExportBook, error) {
+	var data ExportBook
+
+	orderBy, ok := exportOrders[opts.Order]
+	if !ok {
+		return data, fmt.Errorf("unknown order mode %q", opts.Order)
+	}
+
+	query := `
+  SELECT
+    b.id,
+    b.created_on,
+    b.number_of_pages,
+    b.title,
+    COALESCE(b.md5, ''),
+    ` + bookAuthorsSQL + `
+  FROM books b
+  WHERE b.id = ? AND b.user_id = ?;
+  `
+
+	var createdOn int64
+	var authors string
+	err := db.QueryRow(query, bookID, userID).
+		Scan(&data.Book.ID, &createdOn, &data.Book.NumberOfPages, &data.Book.Title, &data.Book.MD5, &authors)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			env.Logger.Error("Failed to query book", "err", err)
+		}
+		return data, err
+	}
+	data.Book.TimeCreatedOn = time.Unix(createdOn, 0)
+	if data.Book.Authors, err = decodeNames(authors); err != nil {
+		return data, err
+	}
+	data.Authors = data.Book.Authors
+
+	query = `SELECT id, time, page, chapter, text, note FROM entries WHERE book_id = ? ORDER BY ` + orderBy + `;`
+	rows, err := db.Query(query, bookID)
+	if err != nil {
+		env.Logger.Error("Failed to query entries", "err", err)
+		return data, err
+	}
+	defer rows.Close()
 
-			if i == 0 || node.entry.Page != mdNodeList[i-1].entry.Page {
-				markdownContent = append(markdownContent, "### Page "+strconv.Itoa(node.entry.Page))
+	for rows.Next() {
+		var entry Entry
+		if err := rows.Scan(&entry.ID, &entry.Time, &entry.Page, &entry.Chapter, &entry.Text, &entry.Note); err != nil {
+			env.Logger.Error("Failed to scan entry", "err", err)
+			return data, err
+		}
+		data.Entries = append(data.Entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return data, err
+	}
+
+	data.Book.EntryCount = len(data.Entries)
+	data.Chapters = groupEntries(data.Entries, GroupChapter)
+	data.Groups = groupEntries(data.Entries, opts.Group)
+	data.ExportedOn = time.Now()
+
+	return data, nil
+}
+
+// groupEntries groups entries by chapter or page, keeping groups in the
+// order they first appear. Each group holds every entry with that key, so a
+// chapter never shows up twice.
+func groupEntries(entries []Entry, group string) []ExportGroup {
+	if group == GroupNone {
+		if len(entries) == 0 {
+			return nil
+		}
+		return []ExportGroup{{Entries: entries}}
+	}
+
+	var groups []ExportGroup
+	index := map[string]int{}
+	for _, entry := range entries {
+		title := entry.Chapter
+		if group == GroupPage {
+			title = "Page " + strconv.Itoa(entry.Page)
+		}
+
+		i, ok := index[title]
+		if !ok {
+			i = len(groups)
+			index[title] = i
+			groups = append(groups, ExportGroup{Title: title})
+		}
+		groups[i].Entries = append(groups[i].Entries, entry)
+	}
+	return groups
+}
+
+// RenderMarkdown renders the built-in Markdown layout.
+func RenderMarkdown(data ExportBook, opts ExportOptions) string {
+	markdownContent := []string{}
+	markdownContent = append(markdownContent, "# Title: "+data.Book.Title)
+	markdownContent = append(markdownContent, "*Authors: "+strings.Join(data.Authors, ", ")+"*")
+	markdownContent = append(
+		markdownContent,
+		"*Date: "+data.Book.TimeCreatedOn.Format("2006-01-02")+"*",
+	)
+	markdownContent = append(markdownContent, "")
+
+	if len(data.Entries) == 0 {
+		markdownContent = append(markdownContent, "*No highlights*", "")
+	}
+
+	for _, group := range data.Groups {
+		if group.Title != "" {
+			markdownContent = append(markdownContent, "## "+group.Title)
+		}
+
+		// Page headings only make sense below chapter headings, and pages are
+		// grouped within the chapter so none shows up twice whatever the order
+		pages := []ExportGroup{{Entries: group.Entries}}
+		if opts.Group == GroupChapter {
+			pages = groupEntries(group.Entries, GroupPage)
+		}
+		for _, page := range pages {
+			if page.Title != "" {
+				markdownContent = append(markdownContent, "### "+page.Title)
 			}
 
-			markdownContent = append(markdownContent, fmt.Sprintf(">%s\n", node.entry.Text))
-			if node.entry.Note != "" {
-				markdownContent = append(markdownContent, node.entry.Note)
+			for _, entry := range page.Entries {
+				markdownContent = append(markdownContent, fmt.Sprintf(">%s\n", entry.Text))
+				if opts.Group == GroupNone {
+					markdownContent = append(markdownContent, fmt.Sprintf("*%s, Page %d*", entry.Chapter, entry.Page))
+				}
+				if entry.Note != "" {
+					markdownContent = append(markdownContent, entry.Note)
+				}
+				markdownContent = append(markdownContent, "")
 			}
-			markdownContent = append(markdownContent, "")
 		}
+	}
 
-		result := strings.Join(markdownContent, "\n")
+	return strings.Join(markdownContent, "\n")
+}
 
-		// Export
-		w.Header().Set("Content-Disposition", "attachment; filename="+mdNodeList[0].title+".md")
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte(result))
-	})
+// ContentDisposition builds an attachment header for name plus ext. The
+// plain filename parameter carries an ASCII fallback, while filename*
+// carries the full UTF-8 name encoded as described in RFC 5987.
+func ContentDisposition(name, ext string) string {
+	filename := SanitizeFilename(name) + ext
+
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, filename)
+
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, fallback, encodeRFC5987(filename))
+}
+
+// SanitizeFilename strips path separators, control and reserved characters
+// from name so it is safe to use as a downloaded file name.
+func SanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			return -1
+		case strings.ContainsRune(`/\:*?"<>|`, r):
+			return '_'
+		}
+		return r
+	}, name)
+
+	name = strings.Trim(strings.TrimSpace(name), ".")
+	if name == "" {
+		return "export"
+	}
+	return name
+}
+
+func encodeRFC5987(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if isAttrChar(c) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func isAttrChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
 }
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/parthshahp/booknotes/internal/db"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+// Healthz reports that the process is up and serving requests.
+func Healthz(env *Env) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// Readyz reports whether the server can take traffic: the database answers
+// and every migration has been applied.
+func Readyz(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+
+		if err := db.PingContext(ctx); err != nil {
+			http.Error(w, "database unavailable", http.StatusServiceUnavailable)
+			env.Logger.ErrorContext(r.Context(), "Error pinging database", "err", err)
+			return
+		}
+		pending, err := db.PendingMigrations()
+		if err != nil {
+			http.Error(w, "database unavailable", http.StatusServiceUnavailable)
+			env.Logger.ErrorContext(r.Context(), "Error reading schema version", "err", err)
+			return
+		}
+		if pending > 0 {
+			http.Error(w, fmt.Sprintf("%d migrations pending", pending), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok\n"))
+	})
+}
@@ -1,93 +1,97 @@
 package api
 
 import (
-	"log"
+	"database/sql"
 
 	"github.com/parthshahp/booknotes/internal/db"
 	. "github.com/parthshahp/booknotes/internal/types"
 )
 
-func GetBookHighlights(db *db.DB, env *Env, bookID string) []Entry {
-	env.InfoLog.Println("Getting highlights")
-	query := `SELECT id, time, page, chapter, text, note FROM entries WHERE book_id = ? ORDER BY page DESC;`
-	queryName := `SELECT title FROM books WHERE id = ?;`
-	rows, err := db.Query(query, bookID)
-	if err != nil {
-		log.Fatalf("Failed to query entries: %s", err)
-	}
-	defer rows.Close()
-
-	var entries []Entry
-	for rows.Next() {
-		var entry Entry
-		if err := rows.Scan(&entry.ID, &entry.Time, &entry.Page, &entry.Chapter, &entry.Text, &entry.Note); err != nil {
-			log.Fatalf("Failed to scan entry: %s", err)
-		}
-		entries = append(entries, entry)
-	}
+func GetBookHighlights(db *db.DB, env *Env, userID int, bookID string) ([]Entry, error) {
+	env.Logger.Debug("Getting highlights")
+	query := `SELECT id, time, page, chapter, text, note FROM entries WHERE book_id = ? AND user_id = ? ORDER BY page DESC;`
+	return queryEntries(db, env, query, bookID, userID)
+}
 
-	var bookName string
-	rows, err = db.Query(queryName, bookID)
+// UpdateHighlight saves the highlight's page, chapter, text and note and
+// returns it as stored. It returns sql.ErrNoRows when the user has no such
+// highlight.
+func UpdateHighlight(db *db.DB, env *Env, userID int, highlight Entry) (Entry, error) {
+	query := `UPDATE entries SET page = ?, chapter = ?, text = ?, note = ? WHERE id = ? AND user_id = ?;`
+	res, err := db.Exec(query, highlight.Page, highlight.Chapter, highlight.Text, highlight.Note, highlight.ID, userID)
 	if err != nil {
-		log.Fatalf("Failed to query name: %s", err)
+		env.Logger.Error("Failed to update highlight", "err", err)
+		return Entry{}, err
 	}
-	defer rows.Close()
-
-	rows.Next()
-	if err := rows.Scan(&bookName); err != nil {
-		log.Fatalf("Failed to scan name: %s", err)
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return Entry{}, sql.ErrNoRows
 	}
 
-	return entries
-}
-
-func UpdateHighlight(db *db.DB, env *Env, highlight Entry) Entry {
-	query := `UPDATE entries SET page = ?, chapter = ?, text = ?, note = ? WHERE id = ?;`
-	stmt, err := db.Prepare(query)
+	// Return the updated highlight from the db
+	var updated Entry
+	query = `SELECT id, time, page, chapter, text, note FROM entries WHERE id = ?;`
+	err = db.QueryRow(query, highlight.ID).
+		Scan(&updated.ID, &updated.Time, &updated.Page, &updated.Chapter, &updated.Text, &updated.Note)
 	if err != nil {
-		env.ErrorLog.Fatalf("Failed to prepare query: %s", err)
+		env.Logger.Error("Failed to query entry", "err", err)
+		return Entry{}, err
 	}
-	defer stmt.Close()
+	return updated, nil
+}
 
-	if _, err := stmt.Exec(highlight.Page, highlight.Chapter, highlight.Text, highlight.Note, highlight.ID); err != nil {
-		env.ErrorLog.Fatalf("Failed to update highlight: %s", err)
-	}
+func SearchAllHighlights(db *db.DB, env *Env, userID int, search string) ([]Entry, error) {
+	env.Logger.Debug("Searching highlights in DB")
+	searchQuery := "%" + search + "%"
+	query := `SELECT id, time, page, chapter, text, note FROM entries WHERE user_id = ? AND text LIKE ? ORDER BY page DESC;`
+	return queryEntries(db, env, query, userID, searchQuery)
+}
 
-	// Return the updated highlight from the db
-	query = `SELECT id, time, page, chapter, text, note FROM entries WHERE id = ?;`
-	rows, err := db.Query(query, highlight.ID)
+func queryEntries(db *db.DB, env *Env, query string, args ...any) ([]Entry, error) {
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		env.ErrorLog.Fatalf("Failed to query entry: %s", err)
+		env.Logger.Error("Failed to query entries", "err", err)
+		return nil, err
 	}
 	defer rows.Close()
 
-	var updatedEntry Entry
+	var entries []Entry
 	for rows.Next() {
-		if err := rows.Scan(&updatedEntry.ID, &updatedEntry.Time, &updatedEntry.Page, &updatedEntry.Chapter, &updatedEntry.Text, &updatedEntry.Note); err != nil {
-			env.ErrorLog.Fatalf("Failed to scan entry: %s", err)
+		var entry Entry
+		if err := rows.Scan(&entry.ID, &entry.Time, &entry.Page, &entry.Chapter, &entry.Text, &entry.Note); err != nil {
+			env.Logger.Error("Failed to scan entry", "err", err)
+			return nil, err
 		}
+		entries = append(entries, entry)
 	}
-	return updatedEntry
+	return entries, rows.Err()
 }
 
-func SearchAllHighlights(db *db.DB, env *Env, search string) []Entry {
-	env.InfoLog.Println("Searching highlights in DB")
+// FindHighlights returns the user's highlights whose text or note contains
+// search, most recent first.
+func FindHighlights(db *db.DB, env *Env, userID int, search string) ([]BookEntry, error) {
 	searchQuery := "%" + search + "%"
-	query := `SELECT id, time, page, chapter, text, note FROM entries WHERE text LIKE ? ORDER BY page DESC;`
-	rows, err := db.Query(query, searchQuery)
+	rows, err := db.Query(`
+    SELECT e.id, e.time, e.page, e.chapter, e.text, e.note, b.id, b.title
+    FROM entries e
+    JOIN books b ON e.book_id = b.id
+    WHERE e.user_id = ? AND (e.text LIKE ? OR e.note LIKE ?)
+    ORDER BY e.time DESC, e.id DESC;
+  `, userID, searchQuery, searchQuery)
 	if err != nil {
-		env.ErrorLog.Fatalf("Failed to query entries: %s", err)
+		env.Logger.Error("Failed to query entries", "err", err)
+		return nil, err
 	}
 	defer rows.Close()
 
-	var entries []Entry
+	var entries []BookEntry
 	for rows.Next() {
-		var entry Entry
-		if err := rows.Scan(&entry.ID, &entry.Time, &entry.Page, &entry.Chapter, &entry.Text, &entry.Note); err != nil {
-			env.ErrorLog.Fatalf("Failed to scan entry: %s", err)
+		var entry BookEntry
+		if err := rows.Scan(&entry.ID, &entry.Time, &entry.Page, &entry.Chapter, &entry.Text, &entry.Note,
+			&entry.BookID, &entry.BookTitle); err != nil {
+			env.Logger.Error("Failed to scan entry", "err", err)
+			return nil, err
 		}
-		env.InfoLog.Println("Entry Found:", entry)
 		entries = append(entries, entry)
 	}
-	return entries
+	return entries, rows.Err()
 }
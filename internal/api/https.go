@@ -0,0 +1,40 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+// StrictTransportSecurity tells browsers to only use HTTPS from now on. The
+// header is only sent over HTTPS, including HTTPS a trusted proxy
+// terminated, as browsers ignore it otherwise.
+func StrictTransportSecurity(env *Env) func(http.Handler) http.Handler {
+	value := fmt.Sprintf("max-age=%d", int(env.TLS.HSTSMaxAge.Seconds()))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isHTTPS(r) && env.TLS.HSTSMaxAge > 0 {
+				w.Header().Set("Strict-Transport-Security", value)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RedirectToHTTPS sends plain HTTP requests to the same URL over HTTPS on
+// the server listening on addr.
+func RedirectToHTTPS(env *Env, addr string) http.HandlerFunc {
+	_, port, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -2,81 +2,230 @@ package api
 
 import (
 	"database/sql"
-	"strings"
+	"slices"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/parthshahp/booknotes/internal/db"
 	. "github.com/parthshahp/booknotes/internal/types"
 )
 
-func InsertData(book BookImport, db *db.DB, env *Env) error {
-	env.InfoLog.Println("Inserting data")
-	insertBook := `INSERT INTO books (created_on, number_of_pages, title) VALUES (?, ?, ?)`
-	res, err := db.Exec(
+// ImportResult is what an import changed.
+type ImportResult struct {
+	BookID   int64
+	Created  bool
+	EntryIDs []int64
+}
+
+func InsertData(book BookImport, db *db.DB, env *Env, userID int) error {
+	_, err := ImportBook(book, db, env, userID)
+	return err
+}
+
+// ImportBook adds the highlights to the user's copy of the book, creating
+// the book when it isn't in the library yet. Books are matched on KOReader's
+// md5 when there is one and on title and authors otherwise. Highlights
+// already in the book, the same text on the same page, are not added again
+// but pick up a changed note.
+func ImportBook(book BookImport, db *db.DB, env *Env, userID int) (ImportResult, error) {
+	env.Logger.Debug("Inserting data")
+	var result ImportResult
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	// Authors are separated by newlines, as in KOReader
+	authors := splitList(book.Author, "\n")
+
+	result.BookID, err = findBook(tx, userID, book, authors)
+	if err != nil && err != sql.ErrNoRows {
+		env.Logger.Error("Failed to query book", "err", err)
+		return result, err
+	}
+	if err == sql.ErrNoRows {
+		result.Created = true
+		if result.BookID, err = insertBook(tx, env, userID, book, authors); err != nil {
+			return result, err
+		}
+	}
+
+	if result.EntryIDs, err = insertEntries(tx, env, userID, result.BookID, book.Entries); err != nil {
+		return result, err
+	}
+
+	// Fill in the md5 of books first imported without one
+	if book.MD5 != "" && !result.Created {
+		if _, err := tx.Exec(`UPDATE books SET md5 = ? WHERE id = ? AND md5 IS NULL;`, book.MD5, result.BookID); err != nil {
+			env.Logger.Error("Failed to update book md5", "err", err)
+			return result, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return result, err
+	}
+
+	env.Logger.Debug("Data inserted successfully")
+
+	return result, nil
+}
+
+// findBook returns the id of the user's book matching the import.
+func findBook(tx *sql.Tx, userID int, book BookImport, authors []string) (int64, error) {
+	var bookID int64
+	if book.MD5 != "" {
+		err := tx.QueryRow(`SELECT id FROM books WHERE user_id = ? AND md5 = ?;`, userID, book.MD5).Scan(&bookID)
+		if err != sql.ErrNoRows {
+			return bookID, err
+		}
+	}
+
+	rows, err := tx.Query(`
+    SELECT b.id, `+bookAuthorsSQL+`
+    FROM books b
+    WHERE b.user_id = ? AND b.title = ?
+    ORDER BY b.id;
+  `, userID, book.Title)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	want := slices.Clone(authors)
+	slices.Sort(want)
+	for rows.Next() {
+		var names string
+		if err := rows.Scan(&bookID, &names); err != nil {
+			return 0, err
+		}
+		have, err := decodeNames(names)
+		if err != nil {
+			return 0, err
+		}
+		slices.Sort(have)
+		if slices.Equal(have, want) {
+			return bookID, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return 0, sql.ErrNoRows
+}
+
+// AddEntries adds highlights to one of the user's books, skipping the ones
+// it already has like ImportBook does.
+func AddEntries(db *db.DB, env *Env, userID int, bookID int64, entries []Entry) ([]int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ids, err := insertEntries(tx, env, userID, bookID, entries)
+	if err != nil {
+		return nil, err
+	}
+	return ids, tx.Commit()
+}
+
+// insertEntries adds the entries not in the book yet and updates the notes
+// of the ones that are, returning the ids of both.
+func insertEntries(tx *sql.Tx, env *Env, userID int, bookID int64, entries []Entry) ([]int64, error) {
+	var ids []int64
+	for _, entry := range entries {
+		var entryID int64
+		var note string
+		err := tx.QueryRow(
+			`SELECT id, COALESCE(note, '') FROM entries WHERE book_id = ? AND text = ? AND page = ?;`,
+			bookID, entry.Text, entry.Page,
+		).Scan(&entryID, &note)
+		switch {
+		case err == sql.ErrNoRows:
+			insertEntry := `INSERT INTO entries (user_id, book_id, time, page, chapter, text, note) VALUES (?, ?, ?, ?, ?, ?, ?)`
+			res, err := tx.Exec(insertEntry, userID, bookID, entry.Time, entry.Page, entry.Chapter, entry.Text, entry.Note)
+			if err != nil {
+				env.Logger.Error("Failed to insert entry data", "err", err)
+				return nil, err
+			}
+			if entryID, err = res.LastInsertId(); err != nil {
+				return nil, err
+			}
+		case err != nil:
+			env.Logger.Error("Failed to query entry", "err", err)
+			return nil, err
+		case entry.Note != "" && entry.Note != note:
+			if _, err := tx.Exec(`UPDATE entries SET note = ? WHERE id = ?;`, entry.Note, entryID); err != nil {
+				env.Logger.Error("Failed to update entry note", "err", err)
+				return nil, err
+			}
+		default:
+			continue
+		}
+		ids = append(ids, entryID)
+	}
+	return ids, nil
+}
+
+func insertBook(tx *sql.Tx, env *Env, userID int, book BookImport, authors []string) (int64, error) {
+	insertBook := `INSERT INTO books (user_id, created_on, number_of_pages, title, md5) VALUES (?, ?, ?, ?, NULLIF(?, ''))`
+	res, err := tx.Exec(
 		insertBook,
+		userID,
 		book.EpochCreatedOn,
 		book.NumberOfPages,
 		book.Title,
+		book.MD5,
 	)
 	if err != nil {
-		env.ErrorLog.Printf("Failed to insert book data: %s", err)
-		return err
+		env.Logger.Error("Failed to insert book data", "err", err)
+		return 0, err
 	}
 
 	// Get the book_id of the inserted book
 	bookID, err := res.LastInsertId()
 	if err != nil {
-		env.ErrorLog.Printf("Failed to get last insert id: %s", err)
-		return err
+		env.Logger.Error("Failed to get last insert id", "err", err)
+		return 0, err
 	}
 
-	// Split authors and insert if they don't exist
-	authors := strings.Split(book.Author, "\n")
+	// Insert authors if they don't exist
 	for _, author := range authors {
 		// Check if author already exists
 		var authorID int64
 		queryAuthor := `SELECT id FROM authors WHERE name = ?`
-		err = db.QueryRow(queryAuthor, author).Scan(&authorID)
+		err = tx.QueryRow(queryAuthor, author).Scan(&authorID)
 		if err != nil && err != sql.ErrNoRows {
-			env.ErrorLog.Printf("Failed to query author: %s", err)
-			return err
+			env.Logger.Error("Failed to query author", "err", err)
+			return 0, err
 		}
 
 		if err == sql.ErrNoRows {
 			// Insert author if not exists
 			insertAuthor := `INSERT INTO authors (name) VALUES (?)`
-			res, err := db.Exec(insertAuthor, author)
+			res, err := tx.Exec(insertAuthor, author)
 			if err != nil {
-				env.ErrorLog.Printf("Failed to insert author data: %s", err)
-				return err
+				env.Logger.Error("Failed to insert author data", "err", err)
+				return 0, err
 			}
 
 			// Get the author_id of the inserted author
 			authorID, err = res.LastInsertId()
 			if err != nil {
-				env.ErrorLog.Printf("Failed to get last insert id: %s", err)
-				return err
+				env.Logger.Error("Failed to get last insert id", "err", err)
+				return 0, err
 			}
 		}
 
 		// Link book and author
 		insertBookAuthor := `INSERT INTO book_authors (book_id, author_id) VALUES (?, ?)`
-		if _, err := db.Exec(insertBookAuthor, bookID, authorID); err != nil {
-			env.ErrorLog.Printf("Failed to insert book_author data: %s", err)
-			return err
-		}
-	}
-
-	// Insert entries data
-	insertEntry := `INSERT INTO entries (book_id, time, page, chapter, text, note) VALUES (?, ?, ?, ?, ?, ?)`
-	for _, entry := range book.Entries {
-		if _, err := db.Exec(insertEntry, bookID, entry.Time, entry.Page, entry.Chapter, entry.Text, entry.Note); err != nil {
-			env.ErrorLog.Printf("Failed to insert entry data: %s", err)
-			return err
+		if _, err := tx.Exec(insertBookAuthor, bookID, authorID); err != nil {
+			env.Logger.Error("Failed to insert book_author data", "err", err)
+			return 0, err
 		}
 	}
 
-	env.InfoLog.Println("Data inserted successfully")
-
-	return nil
+	return bookID, nil
 }
@@ -0,0 +1,274 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parthshahp/booknotes/internal/db"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported file, expected KOReader .json or .lua, My Clippings.txt or a Kobo .sqlite database")
+
+// kindleClippings is the file Kindles append every highlight to.
+const kindleClippings = "my clippings.txt"
+
+// IsImportFile reports whether ParseImportFile understands the file name.
+func IsImportFile(name string) bool {
+	if strings.EqualFold(filepath.Base(name), kindleClippings) {
+		return true
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".lua", ".sqlite":
+		return true
+	}
+	return false
+}
+
+// ParseImportFile reads the books in an exported file, picking the format
+// from its name:
+//
+//   - .json, KOReader's JSON export of one book or of several as documents
+//   - .lua, a KOReader metadata sidecar from a book's .sdr folder
+//   - My Clippings.txt, from a Kindle
+//   - .sqlite, a Kobo's KoboReader.sqlite
+func ParseImportFile(name string, data []byte) ([]BookImport, error) {
+	var books []BookImport
+	var err error
+	switch {
+	case strings.EqualFold(filepath.Base(name), kindleClippings):
+		books, err = parseClippings(data)
+	case strings.EqualFold(filepath.Ext(name), ".json"):
+		books, err = parseJSONExport(data)
+	case strings.EqualFold(filepath.Ext(name), ".lua"):
+		books, err = parseLuaSidecar(name, data)
+	case strings.EqualFold(filepath.Ext(name), ".sqlite"):
+		books, err = parseKoboDatabase(data)
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(books) == 0 {
+		return nil, errors.New("no books found")
+	}
+	return books, nil
+}
+
+func parseJSONExport(data []byte) ([]BookImport, error) {
+	var export struct {
+		BookImport
+		Documents []BookImport `json:"documents"`
+	}
+	if err := json.Unmarshal(data, &export); err != nil {
+		return nil, fmt.Errorf("parse json: %w", err)
+	}
+	if len(export.Documents) > 0 {
+		return export.Documents, nil
+	}
+	if export.Title == "" && len(export.Entries) == 0 {
+		return nil, nil
+	}
+	return []BookImport{export.BookImport}, nil
+}
+
+var (
+	clippingTitle    = regexp.MustCompile(`^(.*?)\s*\(([^()]*)\)$`)
+	clippingPage     = regexp.MustCompile(`(?i)\bpage (\d+)`)
+	clippingLocation = regexp.MustCompile(`(?i)\blocation (\d+)(?:-(\d+))?`)
+	clippingAdded    = regexp.MustCompile(`(?i)\badded on (.+)$`)
+)
+
+// Kindles write the date in the device's locale, these are the English ones
+var clippingTimeLayouts = []string{
+	"Monday, January 2, 2006 3:04:05 PM",
+	"Monday, 2 January 2006 15:04:05",
+}
+
+// parseClippings reads a Kindle's My Clippings.txt. Each clipping is a title
+// line, a line describing it and its text, ended by a line of ='s. Notes are
+// kept as separate clippings and joined to the highlight that ends where
+// they were made, notes made elsewhere become entries of their own.
+func parseClippings(data []byte) ([]BookImport, error) {
+	var books []BookImport
+	index := map[string]int{}
+	// Where each book's entries end, to find the highlight a note is on
+	ends := map[int][]string{}
+	now := time.Now().Unix()
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	var lines []string
+	flush := func() {
+		defer func() { lines = nil }()
+		if len(lines) < 2 {
+			return
+		}
+		header, meta := strings.TrimPrefix(strings.TrimSpace(lines[0]), "\ufeff"), lines[1]
+		text := strings.TrimSpace(strings.Join(lines[2:], "\n"))
+		lowerMeta := strings.ToLower(meta)
+		isNote := strings.Contains(lowerMeta, "note")
+		if text == "" || (!isNote && !strings.Contains(lowerMeta, "highlight")) {
+			// Bookmarks have no text
+			return
+		}
+
+		title, author := header, ""
+		if m := clippingTitle.FindStringSubmatch(header); m != nil {
+			title = m[1]
+			author = strings.Join(splitList(m[2], ";"), "\n")
+		}
+		i, ok := index[header]
+		if !ok {
+			i = len(books)
+			index[header] = i
+			books = append(books, BookImport{Title: title, Author: author, EpochCreatedOn: now})
+		}
+		book := &books[i]
+
+		entry := Entry{Text: text, Time: now}
+		if m := clippingPage.FindStringSubmatch(meta); m != nil {
+			entry.Page, _ = strconv.Atoi(m[1])
+		}
+		var start, end string
+		if m := clippingLocation.FindStringSubmatch(meta); m != nil {
+			start, end = m[1], m[2]
+			if end == "" {
+				end = start
+			}
+		}
+		if m := clippingAdded.FindStringSubmatch(strings.TrimSpace(meta)); m != nil {
+			for _, layout := range clippingTimeLayouts {
+				if t, err := time.ParseInLocation(layout, m[1], time.Local); err == nil {
+					entry.Time = t.Unix()
+					break
+				}
+			}
+		}
+		if isNote {
+			for j := len(book.Entries) - 1; j >= 0; j-- {
+				if start != "" && ends[i][j] == start {
+					book.Entries[j].Note = text
+					return
+				}
+			}
+		}
+		book.Entries = append(book.Entries, entry)
+		ends[i] = append(ends[i], end)
+	}
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(line, "==========") {
+			flush()
+			continue
+		}
+		lines = append(lines, line)
+	}
+	flush()
+	return books, scanner.Err()
+}
+
+// splitList splits s on sep, dropping empty items.
+func splitList(s, sep string) []string {
+	var items []string
+	for _, item := range strings.Split(s, sep) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Kobo dates come with or without fractions and a zone
+var koboTimeLayouts = []string{
+	"2006-01-02T15:04:05.000Z07:00",
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05.000",
+	"2006-01-02T15:04:05",
+}
+
+// parseKoboDatabase reads the highlights from the Bookmark table of a
+// Kobo's KoboReader.sqlite. SQLite needs a file, so it is opened from a
+// temporary copy.
+func parseKoboDatabase(data []byte) ([]BookImport, error) {
+	tmp, err := os.CreateTemp("", "booknotes-*.sqlite")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	kobo, err := db.OpenDB("file:" + tmp.Name() + "?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer kobo.CloseDB()
+
+	rows, err := kobo.Query(`
+    SELECT
+      b.VolumeID,
+      COALESCE(v.Title, ''),
+      COALESCE(v.Attribution, ''),
+      COALESCE(c.Title, ''),
+      b.Text,
+      COALESCE(b.Annotation, ''),
+      COALESCE(b.DateCreated, '')
+    FROM Bookmark b
+    LEFT JOIN content v ON v.ContentID = b.VolumeID
+    LEFT JOIN content c ON c.ContentID = b.ContentID
+    WHERE TRIM(COALESCE(b.Text, '')) != ''
+    ORDER BY b.VolumeID, b.DateCreated;
+  `)
+	if err != nil {
+		return nil, fmt.Errorf("not a Kobo database: %w", err)
+	}
+	defer rows.Close()
+
+	var books []BookImport
+	index := map[string]int{}
+	now := time.Now().Unix()
+	for rows.Next() {
+		var volume, title, author, chapter, created string
+		entry := Entry{Time: now}
+		if err := rows.Scan(&volume, &title, &author, &chapter, &entry.Text, &entry.Note, &created); err != nil {
+			return nil, err
+		}
+		entry.Text = strings.TrimSpace(entry.Text)
+		entry.Chapter = chapter
+		for _, layout := range koboTimeLayouts {
+			if t, err := time.Parse(layout, created); err == nil {
+				entry.Time = t.Unix()
+				break
+			}
+		}
+
+		i, ok := index[volume]
+		if !ok {
+			if title == "" {
+				title = strings.TrimSuffix(filepath.Base(volume), filepath.Ext(volume))
+			}
+			i = len(books)
+			index[volume] = i
+			books = append(books, BookImport{Title: title, Author: author, EpochCreatedOn: now})
+		}
+		books[i].Entries = append(books[i].Entries, entry)
+	}
+	return books, rows.Err()
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/a-h/templ"
+
+	ui "github.com/parthshahp/booknotes/components"
+	"github.com/parthshahp/booknotes/internal/db"
+	"github.com/parthshahp/booknotes/internal/metrics"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+// IngestFile imports every book in an uploaded or watched file and records
+// the outcome in the user's import history. A file already imported as is
+// is recorded as a duplicate and skipped. The error is also the record's.
+func IngestFile(db *db.DB, env *Env, userID int, source, name string, data []byte) (ImportRecord, error) {
+	sum := sha256.Sum256(data)
+	record := ImportRecord{
+		Source:    source,
+		Name:      name,
+		Checksum:  hex.EncodeToString(sum[:]),
+		Status:    ImportDone,
+		CreatedOn: time.Now(),
+	}
+
+	var seen bool
+	err := db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM import_history WHERE user_id = ? AND checksum = ? AND status = ?);`,
+		userID, record.Checksum, ImportDone,
+	).Scan(&seen)
+	if err != nil {
+		env.Logger.Error("Failed to query import history", "err", err)
+		return record, err
+	}
+
+	if seen {
+		record.Status = ImportDuplicate
+	} else {
+		err = ingest(db, env, userID, name, data, &record)
+		if err != nil {
+			record.Status = ImportFailed
+			record.Error = err.Error()
+		}
+	}
+
+	metrics.Imports.WithLabelValues(record.Source, record.Status).Inc()
+
+	res, dbErr := db.Exec(`
+    INSERT INTO import_history (user_id, source, name, checksum, status, error, books, entries, created_on)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
+  `, userID, record.Source, record.Name, record.Checksum, record.Status, record.Error, record.Books, record.Entries, record.CreatedOn.Unix())
+	if dbErr != nil {
+		env.Logger.Error("Failed to record import", "err", dbErr)
+	} else if id, err := res.LastInsertId(); err == nil {
+		record.ID = int(id)
+	}
+	return record, err
+}
+
+// ErrInvalidFile matches errors about the file itself, importing it again
+// won't help.
+var ErrInvalidFile = errors.New("invalid import file")
+
+type invalidFileError struct{ err error }
+
+func (e invalidFileError) Error() string        { return e.err.Error() }
+func (e invalidFileError) Unwrap() error        { return e.err }
+func (e invalidFileError) Is(target error) bool { return target == ErrInvalidFile }
+
+func ingest(db *db.DB, env *Env, userID int, name string, data []byte, record *ImportRecord) error {
+	books, err := ParseImportFile(name, data)
+	if err != nil {
+		return invalidFileError{err}
+	}
+	for _, book := range books {
+		result, err := ImportBook(book, db, env, userID)
+		if err != nil {
+			return err
+		}
+		record.Books++
+		record.Entries += len(result.EntryIDs)
+	}
+	return nil
+}
+
+// GetImportHistory returns the user's most recent imports, newest first.
+func GetImportHistory(db *db.DB, env *Env, userID, limit int) ([]ImportRecord, error) {
+	rows, err := db.Query(`
+    SELECT id, source, name, checksum, status, COALESCE(error, ''), books, entries, created_on
+    FROM import_history
+    WHERE user_id = ?
+    ORDER BY created_on DESC, id DESC
+    LIMIT ?;
+  `, userID, limit)
+	if err != nil {
+		env.Logger.Error("Failed to query import history", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []ImportRecord
+	for rows.Next() {
+		var record ImportRecord
+		var createdOn int64
+		if err := rows.Scan(&record.ID, &record.Source, &record.Name, &record.Checksum, &record.Status,
+			&record.Error, &record.Books, &record.Entries, &createdOn); err != nil {
+			env.Logger.Error("Failed to scan import record", "err", err)
+			return nil, err
+		}
+		record.CreatedOn = time.Unix(createdOn, 0)
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func ImportHistoryPage(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving import history")
+		records, err := GetImportHistory(db, env, CurrentUser(r).ID, 200)
+		if err != nil {
+			http.Error(w, "Unable to load import history", http.StatusInternalServerError)
+			return
+		}
+		templ.Handler(ui.ImportHistoryPage(records, env.Watch)).ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,243 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/a-h/templ"
+
+	ui "github.com/parthshahp/booknotes/components"
+	"github.com/parthshahp/booknotes/internal/db"
+	"github.com/parthshahp/booknotes/internal/jobs"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+// JobImport imports the files of an upload in the background.
+const JobImport = "import"
+
+// importMaxAttempts retries imports that fail for reasons other than the
+// files themselves, such as a busy database.
+const importMaxAttempts = 3
+
+type upload struct {
+	name string
+	data []byte
+}
+
+// readUploads reads the "file" fields of a multipart upload. The parts are
+// streamed unless the form was already parsed, as when the CSRF token came
+// as a form field.
+func readUploads(r *http.Request) ([]upload, error) {
+	var uploads []upload
+	if r.MultipartForm != nil {
+		for _, f := range r.MultipartForm.File["file"] {
+			file, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			data, err := io.ReadAll(file)
+			file.Close()
+			if err != nil {
+				return nil, err
+			}
+			uploads = append(uploads, upload{f.Filename, data})
+		}
+		return uploads, nil
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return uploads, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			continue
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload{part.FileName(), data})
+	}
+}
+
+// enqueueImport stores the uploaded files and queues a job importing them.
+func enqueueImport(db *db.DB, queue *jobs.Queue, userID int, uploads []upload) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	jobID, err := queue.Enqueue(tx, userID, JobImport, importMaxAttempts)
+	if err != nil {
+		return 0, err
+	}
+	for _, u := range uploads {
+		if _, err := tx.Exec(`INSERT INTO import_files (job_id, name, data, status) VALUES (?, ?, ?, ?);`,
+			jobID, u.name, u.data, JobQueued); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	queue.Wake()
+	return jobID, nil
+}
+
+// RunImportJob imports the job's files one at a time, skipping the ones an
+// earlier attempt finished. Files that can't be parsed are marked failed,
+// other errors fail the attempt so the job is retried.
+func RunImportJob(env *Env, db *db.DB) jobs.Handler {
+	return func(ctx context.Context, job jobs.Job) error {
+		rows, err := db.Query(`SELECT id FROM import_files WHERE job_id = ? AND status IN (?, ?) ORDER BY id;`,
+			job.ID, JobQueued, JobRunning)
+		if err != nil {
+			return err
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := importJobFile(db, env, job.UserID, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func importJobFile(db *db.DB, env *Env, userID, id int) error {
+	var name string
+	var data []byte
+	err := db.QueryRow(`SELECT name, data FROM import_files WHERE id = ?;`, id).Scan(&name, &data)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(`UPDATE import_files SET status = ? WHERE id = ?;`, JobRunning, id); err != nil {
+		return err
+	}
+
+	record, err := IngestFile(db, env, userID, ImportSourceUpload, name, data)
+	if err != nil && !errors.Is(err, ErrInvalidFile) {
+		db.Exec(`UPDATE import_files SET status = ? WHERE id = ?;`, JobQueued, id)
+		return fmt.Errorf("import %s: %w", name, err)
+	}
+
+	// The data is no longer needed once the file is processed
+	_, err = db.Exec(`UPDATE import_files SET status = ?, error = ?, books = ?, entries = ?, data = NULL WHERE id = ?;`,
+		record.Status, record.Error, record.Books, record.Entries, id)
+	return err
+}
+
+// FailImportJob marks the files a failed import job never got to as failed
+// and releases their uploaded data.
+func FailImportJob(env *Env, db *db.DB) jobs.FailureHandler {
+	return func(job jobs.Job, err error) {
+		_, dbErr := db.Exec(`
+      UPDATE import_files SET status = ?, error = ?, data = NULL
+      WHERE job_id = ? AND status IN (?, ?);
+    `, ImportFailed, err.Error(), job.ID, JobQueued, JobRunning)
+		if dbErr != nil {
+			env.Logger.Error("Failed to fail import files", "job", job.ID, "err", dbErr)
+		}
+	}
+}
+
+// GetImportJob returns the user's import job with the progress of its files.
+func GetImportJob(db *db.DB, queue *jobs.Queue, userID, id int) (ImportJob, error) {
+	job, err := queue.Get(userID, id)
+	if err != nil {
+		return ImportJob{}, err
+	}
+	if job.Kind != JobImport {
+		return ImportJob{}, sql.ErrNoRows
+	}
+
+	importJob := ImportJob{ID: job.ID, Status: job.Status, Error: job.Error}
+	rows, err := db.Query(`
+    SELECT name, status, COALESCE(error, ''), books, entries
+    FROM import_files
+    WHERE job_id = ?
+    ORDER BY id;
+  `, id)
+	if err != nil {
+		return importJob, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var f ImportJobFile
+		if err := rows.Scan(&f.Name, &f.Status, &f.Error, &f.Books, &f.Entries); err != nil {
+			return importJob, err
+		}
+		importJob.Files = append(importJob.Files, f)
+	}
+	return importJob, rows.Err()
+}
+
+// GetActiveImportJobs returns the user's import jobs still in progress.
+func GetActiveImportJobs(db *db.DB, queue *jobs.Queue, userID int) ([]ImportJob, error) {
+	active, err := queue.Active(userID, JobImport)
+	if err != nil {
+		return nil, err
+	}
+	var importJobs []ImportJob
+	for _, job := range active {
+		importJob, err := GetImportJob(db, queue, userID, job.ID)
+		if err != nil {
+			return nil, err
+		}
+		importJobs = append(importJobs, importJob)
+	}
+	return importJobs, nil
+}
+
+// ImportJobStatus renders a job's progress. The fragment polls itself until
+// the job finishes.
+func ImportJobStatus(env *Env, db *db.DB, queue *jobs.Queue) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Import not found", http.StatusNotFound)
+			return
+		}
+		job, err := GetImportJob(db, queue, CurrentUser(r).ID, id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Import not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Unable to load import", http.StatusInternalServerError)
+			env.Logger.ErrorContext(r.Context(), "Error loading import job", "err", err)
+			return
+		}
+		templ.Handler(ui.ImportJobProgress(job)).ServeHTTP(w, r)
+	})
+}
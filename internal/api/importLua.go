@@ -0,0 +1,408 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+// luaTable is a Lua table literal. Keys are strings, or float64 for list
+// items and numeric keys.
+type luaTable map[any]any
+
+func (t luaTable) str(key string) string {
+	s, _ := t[key].(string)
+	return s
+}
+
+func (t luaTable) num(key string) int {
+	n, _ := t[key].(float64)
+	return int(n)
+}
+
+func (t luaTable) table(key string) luaTable {
+	sub, _ := t[key].(luaTable)
+	return sub
+}
+
+// list returns the values under numeric keys in key order.
+func (t luaTable) list() []any {
+	var keys []float64
+	for k := range t {
+		if n, ok := k.(float64); ok {
+			keys = append(keys, n)
+		}
+	}
+	sort.Float64s(keys)
+	values := make([]any, len(keys))
+	for i, k := range keys {
+		values[i] = t[k]
+	}
+	return values
+}
+
+// luaParser reads the "return { ... }" files KOReader writes its settings
+// and book sidecars as. Only the literal subset of Lua found in them is
+// understood.
+type luaParser struct {
+	src string
+	pos int
+}
+
+func parseLua(src string) (any, error) {
+	p := &luaParser{src: src}
+	p.skip()
+	if strings.HasPrefix(p.src[p.pos:], "return") {
+		p.pos += len("return")
+	}
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	if p.skip(); p.pos < len(p.src) {
+		return nil, p.errorf("unexpected %q", p.src[p.pos])
+	}
+	return v, nil
+}
+
+func (p *luaParser) errorf(format string, args ...any) error {
+	line := strings.Count(p.src[:p.pos], "\n") + 1
+	return fmt.Errorf("lua line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// skip moves past white space and comments.
+func (p *luaParser) skip() {
+	for p.pos < len(p.src) {
+		switch {
+		case strings.ContainsRune(" \t\r\n", rune(p.src[p.pos])):
+			p.pos++
+		case strings.HasPrefix(p.src[p.pos:], "--[["):
+			end := strings.Index(p.src[p.pos:], "]]")
+			if end < 0 {
+				p.pos = len(p.src)
+				return
+			}
+			p.pos += end + 2
+		case strings.HasPrefix(p.src[p.pos:], "--"):
+			end := strings.IndexByte(p.src[p.pos:], '\n')
+			if end < 0 {
+				p.pos = len(p.src)
+				return
+			}
+			p.pos += end
+		default:
+			return
+		}
+	}
+}
+
+func (p *luaParser) value() (any, error) {
+	p.skip()
+	if p.pos >= len(p.src) {
+		return nil, p.errorf("unexpected end of file")
+	}
+	switch c := p.src[p.pos]; {
+	case c == '{':
+		return p.table()
+	case c == '"' || c == '\'':
+		return p.string()
+	case strings.HasPrefix(p.src[p.pos:], "[["):
+		end := strings.Index(p.src[p.pos+2:], "]]")
+		if end < 0 {
+			return nil, p.errorf("unterminated long string")
+		}
+		s := strings.TrimPrefix(p.src[p.pos+2:p.pos+2+end], "\n")
+		p.pos += end + 4
+		return s, nil
+	case c == '-' || c == '.' || ('0' <= c && c <= '9'):
+		return p.number()
+	}
+
+	name := p.name()
+	switch name {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "nil":
+		return nil, nil
+	case "":
+		return nil, p.errorf("unexpected %q", p.src[p.pos])
+	}
+	return nil, p.errorf("unexpected %q", name)
+}
+
+func (p *luaParser) name() string {
+	start := p.pos
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c != '_' && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && !(p.pos > start && '0' <= c && c <= '9') {
+			break
+		}
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *luaParser) number() (any, error) {
+	start := p.pos
+	for p.pos < len(p.src) && strings.IndexByte("0123456789abcdefABCDEFxX.+-", p.src[p.pos]) >= 0 {
+		// A sign only belongs to the number at the start or after an exponent
+		if c := p.src[p.pos]; (c == '+' || c == '-') && p.pos > start && !strings.ContainsRune("eE", rune(p.src[p.pos-1])) {
+			break
+		}
+		p.pos++
+	}
+	text := p.src[start:p.pos]
+	if strings.ContainsAny(text, "xX") {
+		n, err := strconv.ParseInt(text, 0, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", text)
+		}
+		return float64(n), nil
+	}
+	n, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return nil, p.errorf("invalid number %q", text)
+	}
+	return n, nil
+}
+
+func (p *luaParser) string() (string, error) {
+	quote := p.src[p.pos]
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		p.pos++
+		switch {
+		case c == quote:
+			return b.String(), nil
+		case c == '\n':
+			return "", p.errorf("unterminated string")
+		case c != '\\':
+			b.WriteByte(c)
+			continue
+		}
+
+		if p.pos >= len(p.src) {
+			break
+		}
+		e := p.src[p.pos]
+		p.pos++
+		switch e {
+		case 'n', '\n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'v':
+			b.WriteByte('\v')
+		case 'x':
+			if p.pos+2 > len(p.src) {
+				return "", p.errorf("invalid escape")
+			}
+			n, err := strconv.ParseUint(p.src[p.pos:p.pos+2], 16, 8)
+			if err != nil {
+				return "", p.errorf("invalid escape")
+			}
+			b.WriteByte(byte(n))
+			p.pos += 2
+		default:
+			if '0' <= e && e <= '9' {
+				// Up to three decimal digits give the byte
+				start := p.pos - 1
+				for p.pos < len(p.src) && p.pos-start < 3 && '0' <= p.src[p.pos] && p.src[p.pos] <= '9' {
+					p.pos++
+				}
+				n, err := strconv.ParseUint(p.src[start:p.pos], 10, 8)
+				if err != nil {
+					return "", p.errorf("invalid escape")
+				}
+				b.WriteByte(byte(n))
+				continue
+			}
+			// \\, \" and \' stand for themselves
+			b.WriteByte(e)
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+func (p *luaParser) table() (luaTable, error) {
+	p.pos++ // {
+	t := luaTable{}
+	next := 1.0
+	for {
+		p.skip()
+		if p.pos >= len(p.src) {
+			return nil, p.errorf("unterminated table")
+		}
+		if p.src[p.pos] == '}' {
+			p.pos++
+			return t, nil
+		}
+
+		var key any
+		switch start := p.pos; {
+		case p.src[p.pos] == '[' && !strings.HasPrefix(p.src[p.pos:], "[["):
+			p.pos++
+			k, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			if p.skip(); !strings.HasPrefix(p.src[p.pos:], "]") {
+				return nil, p.errorf("expected ]")
+			}
+			p.pos++
+			if p.skip(); !strings.HasPrefix(p.src[p.pos:], "=") {
+				return nil, p.errorf("expected =")
+			}
+			p.pos++
+			key = k
+		default:
+			// name = value, or a bare value such as true
+			if name := p.name(); name != "" {
+				p.skip()
+				if strings.HasPrefix(p.src[p.pos:], "=") && !strings.HasPrefix(p.src[p.pos:], "==") {
+					p.pos++
+					key = name
+					break
+				}
+			}
+			p.pos = start
+		}
+
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			key = next
+			next++
+		}
+		t[key] = v
+
+		p.skip()
+		if p.pos < len(p.src) && (p.src[p.pos] == ',' || p.src[p.pos] == ';') {
+			p.pos++
+		}
+	}
+}
+
+// KOReader writes annotation times as local date and time
+const koreaderTimeLayout = "2006-01-02 15:04:05"
+
+func koreaderTime(s string) int64 {
+	t, err := time.ParseInLocation(koreaderTimeLayout, s, time.Local)
+	if err != nil {
+		return time.Now().Unix()
+	}
+	return t.Unix()
+}
+
+// parseLuaSidecar reads the highlights from the metadata.*.lua file KOReader
+// keeps next to each book in its .sdr folder. Both the annotations list of
+// current versions and the older highlight and bookmarks tables are read.
+func parseLuaSidecar(name string, data []byte) ([]BookImport, error) {
+	v, err := parseLua(string(data))
+	if err != nil {
+		return nil, err
+	}
+	sidecar, ok := v.(luaTable)
+	if !ok {
+		return nil, errors.New("not a KOReader sidecar")
+	}
+
+	props, stats := sidecar.table("doc_props"), sidecar.table("stats")
+	book := BookImport{
+		Title:          props.str("title"),
+		Author:         props.str("authors"),
+		MD5:            sidecar.str("partial_md5_checksum"),
+		NumberOfPages:  sidecar.num("doc_pages"),
+		EpochCreatedOn: time.Now().Unix(),
+	}
+	if book.Title == "" {
+		book.Title = stats.str("title")
+	}
+	if book.Title == "" {
+		// The folder is named after the book, "Title.sdr"
+		book.Title = strings.TrimSuffix(filepath.Base(filepath.Dir(name)), ".sdr")
+	}
+	if book.Author == "" {
+		book.Author = stats.str("authors")
+	}
+	if book.NumberOfPages == 0 {
+		book.NumberOfPages = stats.num("pages")
+	}
+
+	if annotations := sidecar.table("annotations"); annotations != nil {
+		for _, item := range annotations.list() {
+			a, _ := item.(luaTable)
+			// Highlights have a position, page bookmarks don't
+			if a == nil || a["pos0"] == nil || a.str("text") == "" {
+				continue
+			}
+			book.Entries = append(book.Entries, Entry{
+				Time:    koreaderTime(a.str("datetime")),
+				Page:    a.num("pageno"),
+				Chapter: a.str("chapter"),
+				Text:    a.str("text"),
+				Note:    a.str("note"),
+			})
+		}
+		return []BookImport{book}, nil
+	}
+
+	// Older versions keep notes on the bookmark made with each highlight
+	notes := map[string]string{}
+	for _, item := range sidecar.table("bookmarks").list() {
+		bm, _ := item.(luaTable)
+		if bm == nil || bm["highlighted"] != true {
+			continue
+		}
+		// Without a note the text is generated, "Page 12 ... @ <datetime>"
+		if text := bm.str("text"); text != "" && !strings.HasSuffix(text, "@ "+bm.str("datetime")) {
+			notes[bm.str("datetime")] = text
+		}
+	}
+
+	highlights := sidecar.table("highlight")
+	var pages []float64
+	for k := range highlights {
+		if n, ok := k.(float64); ok {
+			pages = append(pages, n)
+		}
+	}
+	sort.Float64s(pages)
+	for _, page := range pages {
+		items, _ := highlights[page].(luaTable)
+		for _, item := range items.list() {
+			h, _ := item.(luaTable)
+			if h == nil || h.str("text") == "" {
+				continue
+			}
+			book.Entries = append(book.Entries, Entry{
+				Time:    koreaderTime(h.str("datetime")),
+				Page:    int(page),
+				Chapter: h.str("chapter"),
+				Text:    h.str("text"),
+				Note:    notes[h.str("datetime")],
+			})
+		}
+	}
+	return []BookImport{book}, nil
+}
@@ -0,0 +1,286 @@
+package api
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parthshahp/booknotes/internal/db"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+// KOReader's Joplin exporter talks to the Web Clipper API on whatever
+// address it is given, so these routes live at the root. In KOReader enter
+// the booknotes host and port, and an API token with the import scope as
+// the Joplin token.
+
+// joplinDefaultNotebook is the notebook KOReader exports to by default.
+const joplinDefaultNotebook = "KOReader Notes"
+
+// joplinItem is a note or notebook as the clipper API returns it.
+type joplinItem struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	ParentID string `json:"parent_id"`
+}
+
+type joplinPage struct {
+	Items   []joplinItem `json:"items"`
+	HasMore bool         `json:"has_more"`
+}
+
+// Notebooks aren't stored, every title is a notebook whose id is derived
+// from it. Books go to the library whichever notebook they're sent to.
+func joplinNotebookID(title string) string {
+	sum := md5.Sum([]byte(title))
+	return hex.EncodeToString(sum[:])
+}
+
+// Notes are books, with the book id padded out to the 32 hex digits of a
+// Joplin id.
+func joplinNoteID(bookID int64) string {
+	return fmt.Sprintf("%032x", bookID)
+}
+
+func joplinBookID(noteID string) (int64, error) {
+	return strconv.ParseInt(noteID, 16, 64)
+}
+
+// ParseJoplinNote reads the Markdown note KOReader's exporter writes for a
+// book back into an import. Clippings are separated by "* * *" lines and
+// start with the time they were made, notes follow the text after a "---"
+// line. Chapter titles are written in italics above their clippings.
+func ParseJoplinNote(title, body string) BookImport {
+	book := BookImport{Title: title, EpochCreatedOn: time.Now().Unix()}
+	var chapter string
+	for _, block := range splitJoplinBlocks(body) {
+		lines := strings.Split(block, "\n")
+
+		// A lone italic line is the next chapter's title
+		if len(lines) == 1 && len(lines[0]) > 2 && strings.HasPrefix(lines[0], "*") && strings.HasSuffix(lines[0], "*") {
+			chapter = strings.Trim(lines[0], "*")
+			continue
+		}
+
+		entry := Entry{Chapter: chapter, Time: time.Now().Unix()}
+		if t, err := time.ParseInLocation(koreaderTimeLayout, strings.TrimSpace(lines[0]), time.Local); err == nil {
+			entry.Time = t.Unix()
+			lines = lines[1:]
+		}
+
+		text, note, _ := strings.Cut(strings.Join(lines, "\n"), "\n---\n")
+		entry.Text = strings.TrimSpace(text)
+		entry.Note = strings.TrimSpace(note)
+		if entry.Text != "" {
+			book.Entries = append(book.Entries, entry)
+		}
+	}
+	return book
+}
+
+// splitJoplinBlocks splits a note on its "* * *" separators, dropping blank
+// blocks.
+func splitJoplinBlocks(body string) []string {
+	var blocks []string
+	var current []string
+	flush := func() {
+		if block := strings.TrimSpace(strings.Join(current, "\n")); block != "" {
+			blocks = append(blocks, block)
+		}
+		current = nil
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n") {
+		// KOReader runs the next clipping on after the separator
+		if rest, ok := strings.CutPrefix(strings.TrimSpace(line), "* * *"); ok {
+			flush()
+			line = rest
+		}
+		current = append(current, line)
+	}
+	flush()
+	return blocks
+}
+
+// joplinNotes lists the user's books as notes, only those with the title
+// when there is one.
+func joplinNotes(db *db.DB, env *Env, userID int, title string) ([]joplinItem, error) {
+	query := `SELECT id, title FROM books WHERE user_id = ? ORDER BY id;`
+	args := []any{userID}
+	if title != "" {
+		query = `SELECT id, title FROM books WHERE user_id = ? AND title = ? ORDER BY id;`
+		args = append(args, title)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		env.Logger.Error("Failed to query books", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []joplinItem{}
+	for rows.Next() {
+		var id int64
+		var item joplinItem
+		if err := rows.Scan(&id, &item.Title); err != nil {
+			return nil, err
+		}
+		item.ID = joplinNoteID(id)
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func joplinError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// RequireJoplinToken moves the token the clipper API takes as a query
+// parameter into the Authorization header for RequireToken.
+func RequireJoplinToken(env *Env, db *db.DB) func(http.Handler) http.Handler {
+	requireToken := RequireToken(env, db, ScopeImport)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token := r.URL.Query().Get("token"); token != "" && r.Header.Get("Authorization") == "" {
+				r = r.Clone(r.Context())
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+			requireToken(next).ServeHTTP(w, r)
+		})
+	}
+}
+
+// JoplinPing is how clients find the clipper server.
+func JoplinPing() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("JoplinClipperServer"))
+	})
+}
+
+func JoplinFolders(env *Env) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving joplin folders")
+		writeJSON(w, http.StatusOK, joplinPage{Items: []joplinItem{
+			{ID: joplinNotebookID(joplinDefaultNotebook), Title: joplinDefaultNotebook},
+		}})
+	})
+}
+
+func JoplinCreateFolder(env *Env) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving joplin create folder")
+		var folder joplinItem
+		if err := json.NewDecoder(r.Body).Decode(&folder); err != nil || folder.Title == "" {
+			joplinError(w, http.StatusBadRequest, "Invalid folder")
+			return
+		}
+		folder.ID = joplinNotebookID(folder.Title)
+		writeJSON(w, http.StatusOK, folder)
+	})
+}
+
+// JoplinSearch finds notebooks and notes by title. Every notebook exists.
+func JoplinSearch(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving joplin search")
+		query := r.URL.Query().Get("query")
+		if r.URL.Query().Get("type") == "folder" {
+			writeJSON(w, http.StatusOK, joplinPage{Items: []joplinItem{{ID: joplinNotebookID(query), Title: query}}})
+			return
+		}
+
+		items, err := joplinNotes(db, env, CurrentUser(r).ID, query)
+		if err != nil {
+			joplinError(w, http.StatusInternalServerError, "Unable to search notes")
+			return
+		}
+		writeJSON(w, http.StatusOK, joplinPage{Items: items})
+	})
+}
+
+func JoplinNotes(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving joplin notes")
+		items, err := joplinNotes(db, env, CurrentUser(r).ID, "")
+		if err != nil {
+			joplinError(w, http.StatusInternalServerError, "Unable to load notes")
+			return
+		}
+		writeJSON(w, http.StatusOK, joplinPage{Items: items})
+	})
+}
+
+type joplinNote struct {
+	Title       string `json:"title"`
+	Body        string `json:"body"`
+	ParentID    string `json:"parent_id"`
+	CreatedTime int64  `json:"created_time"`
+}
+
+// JoplinCreateNote imports a book exported from KOReader.
+func JoplinCreateNote(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving joplin create note")
+		var note joplinNote
+		if err := json.NewDecoder(r.Body).Decode(&note); err != nil || strings.TrimSpace(note.Title) == "" {
+			joplinError(w, http.StatusBadRequest, "Invalid note")
+			return
+		}
+
+		book := ParseJoplinNote(strings.TrimSpace(note.Title), note.Body)
+		if note.CreatedTime > 0 {
+			// Joplin times are in milliseconds
+			book.EpochCreatedOn = note.CreatedTime / 1000
+		}
+		result, err := ImportBook(book, db, env, CurrentUser(r).ID)
+		if err != nil {
+			joplinError(w, http.StatusInternalServerError, "Unable to insert data")
+			env.Logger.ErrorContext(r.Context(), "Error inserting data", "err", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, joplinItem{ID: joplinNoteID(result.BookID), Title: book.Title, ParentID: note.ParentID})
+	})
+}
+
+// JoplinUpdateNote adds the clippings of a re-exported book. KOReader sends
+// the whole note again, the ones already in the book are skipped.
+func JoplinUpdateNote(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving joplin update note")
+		user := CurrentUser(r)
+		bookID, err := joplinBookID(r.PathValue("id"))
+		if err != nil {
+			joplinError(w, http.StatusNotFound, "Note not found")
+			return
+		}
+		book, err := GetBook(db, env, user.ID, strconv.FormatInt(bookID, 10))
+		if err == sql.ErrNoRows {
+			joplinError(w, http.StatusNotFound, "Note not found")
+			return
+		}
+		if err != nil {
+			joplinError(w, http.StatusInternalServerError, "Unable to load note")
+			return
+		}
+
+		var note joplinNote
+		if err := json.NewDecoder(r.Body).Decode(&note); err != nil {
+			joplinError(w, http.StatusBadRequest, "Invalid note")
+			return
+		}
+
+		entries := ParseJoplinNote(book.Title, note.Body).Entries
+		if _, err := AddEntries(db, env, user.ID, bookID, entries); err != nil {
+			joplinError(w, http.StatusInternalServerError, "Unable to insert data")
+			env.Logger.ErrorContext(r.Context(), "Error inserting data", "err", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, joplinItem{ID: joplinNoteID(bookID), Title: book.Title, ParentID: note.ParentID})
+	})
+}
@@ -0,0 +1,251 @@
+package api
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/a-h/templ"
+	"golang.org/x/crypto/bcrypt"
+
+	ui "github.com/parthshahp/booknotes/components"
+	"github.com/parthshahp/booknotes/internal/db"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+// kosyncPrefix is where the KOReader progress sync server is mounted. It is
+// the custom sync server address to enter in KOReader.
+const kosyncPrefix = "/kosync"
+
+// Partial md5 hashes are 32 bytes, anything far longer is not a document
+const kosyncMaxDocumentBytes = 1 << 10
+
+// Error codes of the kosync protocol, KOReader shows the message
+const (
+	kosyncUnknownError    = 2000
+	kosyncUnauthorized    = 2001
+	kosyncInvalidRequest  = 2003
+	kosyncDocumentMissing = 2004
+	kosyncSignupDisabled  = 2005
+)
+
+// SetSyncPassword sets the password KOReader logs in with. KOReader only
+// ever sends the md5 of it, so that is what gets hashed.
+func SetSyncPassword(db *db.DB, env *Env, userID int, password string) error {
+	if len(password) < 8 {
+		return errors.New("password must be at least 8 characters")
+	}
+	sum := md5.Sum([]byte(password))
+	hash, err := bcrypt.GenerateFromPassword([]byte(hex.EncodeToString(sum[:])), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(`UPDATE users SET sync_key_hash = ? WHERE id = ?;`, string(hash), userID); err != nil {
+		env.Logger.Error("Failed to set sync password", "err", err)
+		return err
+	}
+	return nil
+}
+
+func HasSyncPassword(db *db.DB, userID int) (bool, error) {
+	var set bool
+	err := db.QueryRow(`SELECT COALESCE(sync_key_hash, '') != '' FROM users WHERE id = ?;`, userID).Scan(&set)
+	return set, err
+}
+
+// AuthenticateSync checks the x-auth-user and x-auth-key headers sent by
+// KOReader.
+func AuthenticateSync(db *db.DB, env *Env, username, key string) (User, error) {
+	var user User
+	var hash string
+	var createdOn int64
+	err := db.QueryRow(
+		`SELECT id, username, role, created_on, COALESCE(sync_key_hash, '') FROM users WHERE username = ?;`,
+		username,
+	).Scan(&user.ID, &user.Username, &user.Role, &createdOn, &hash)
+	if err == sql.ErrNoRows || (err == nil && hash == "") {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(key))
+		return User{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		env.Logger.Error("Failed to query sync user", "err", err)
+		return User{}, err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(strings.ToLower(key))); err != nil {
+		return User{}, ErrInvalidCredentials
+	}
+	user.CreatedOn = time.Unix(createdOn, 0)
+	return user, nil
+}
+
+func GetProgress(db *db.DB, userID int, document string) (ReadingProgress, error) {
+	progress := ReadingProgress{Document: document}
+	var timestamp int64
+	err := db.QueryRow(`
+    SELECT progress, percentage, device, device_id, timestamp
+    FROM kosync_progress
+    WHERE user_id = ? AND document = ?;
+  `, userID, document).Scan(&progress.Progress, &progress.Percentage, &progress.Device, &progress.DeviceID, &timestamp)
+	progress.UpdatedOn = time.Unix(timestamp, 0)
+	return progress, err
+}
+
+func SaveProgress(db *db.DB, env *Env, userID int, progress ReadingProgress) error {
+	_, err := db.Exec(`
+    INSERT INTO kosync_progress (user_id, document, progress, percentage, device, device_id, timestamp)
+    VALUES (?, ?, ?, ?, ?, ?, ?)
+    ON CONFLICT (user_id, document) DO UPDATE SET
+      progress = excluded.progress, percentage = excluded.percentage, device = excluded.device,
+      device_id = excluded.device_id, timestamp = excluded.timestamp;
+  `, userID, progress.Document, progress.Progress, progress.Percentage, progress.Device, progress.DeviceID, progress.UpdatedOn.Unix())
+	if err != nil {
+		env.Logger.Error("Failed to save progress", "err", err)
+	}
+	return err
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func kosyncError(w http.ResponseWriter, status, code int, message string) {
+	writeJSON(w, status, map[string]any{"code": code, "message": message})
+}
+
+// RequireSyncUser authenticates KOReader requests and attaches the user.
+func RequireSyncUser(env *Env, db *db.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, err := AuthenticateSync(db, env, r.Header.Get("x-auth-user"), r.Header.Get("x-auth-key"))
+			if err == ErrInvalidCredentials {
+				kosyncError(w, http.StatusUnauthorized, kosyncUnauthorized, "Unauthorized")
+				return
+			}
+			if err != nil {
+				kosyncError(w, http.StatusInternalServerError, kosyncUnknownError, "Unknown server error")
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), user)))
+		})
+	}
+}
+
+// KosyncRegister refuses registration from KOReader, accounts and their
+// sync passwords are managed in booknotes.
+func KosyncRegister(env *Env) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving kosync register")
+		kosyncError(w, http.StatusPaymentRequired, kosyncSignupDisabled,
+			"Set a sync password for your account in booknotes under KOReader Sync, then log in")
+	})
+}
+
+func KosyncAuthorize(env *Env) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"authorized": "OK"})
+	})
+}
+
+func KosyncUpdateProgress(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var progress ReadingProgress
+		if err := json.NewDecoder(r.Body).Decode(&progress); err != nil {
+			kosyncError(w, http.StatusForbidden, kosyncInvalidRequest, "Invalid request")
+			return
+		}
+		if progress.Document == "" || len(progress.Document) > kosyncMaxDocumentBytes {
+			kosyncError(w, http.StatusForbidden, kosyncDocumentMissing, "Field 'document' not provided.")
+			return
+		}
+		if progress.Progress == "" || progress.Device == "" {
+			kosyncError(w, http.StatusForbidden, kosyncInvalidRequest, "Invalid request")
+			return
+		}
+
+		progress.UpdatedOn = time.Now()
+		if err := SaveProgress(db, env, CurrentUser(r).ID, progress); err != nil {
+			kosyncError(w, http.StatusInternalServerError, kosyncUnknownError, "Unknown server error")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"document":  progress.Document,
+			"timestamp": progress.UpdatedOn.Unix(),
+		})
+	})
+}
+
+func KosyncGetProgress(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		progress, err := GetProgress(db, CurrentUser(r).ID, r.PathValue("document"))
+		if err == sql.ErrNoRows {
+			// KOReader expects an empty object for unknown documents
+			writeJSON(w, http.StatusOK, struct{}{})
+			return
+		}
+		if err != nil {
+			kosyncError(w, http.StatusInternalServerError, kosyncUnknownError, "Unknown server error")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"document":   progress.Document,
+			"progress":   progress.Progress,
+			"percentage": progress.Percentage,
+			"device":     progress.Device,
+			"device_id":  progress.DeviceID,
+			"timestamp":  progress.UpdatedOn.Unix(),
+		})
+	})
+}
+
+func KosyncHealthcheck() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"state": "OK"})
+	})
+}
+
+func KosyncSettingsPage(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving kosync settings")
+		renderKosyncSettings(w, r, env, db, "", "")
+	})
+}
+
+func SaveKosyncSettings(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving save kosync settings")
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Unable to parse form", http.StatusBadRequest)
+			env.Logger.ErrorContext(r.Context(), "Error parsing form", "err", err)
+			return
+		}
+
+		if r.FormValue("password") != r.FormValue("confirm") {
+			renderKosyncSettings(w, r, env, db, "", "Passwords do not match")
+			return
+		}
+		if err := SetSyncPassword(db, env, CurrentUser(r).ID, r.FormValue("password")); err != nil {
+			renderKosyncSettings(w, r, env, db, "", err.Error())
+			return
+		}
+		renderKosyncSettings(w, r, env, db, "Sync password saved", "")
+	})
+}
+
+func renderKosyncSettings(w http.ResponseWriter, r *http.Request, env *Env, db *db.DB, message, errMsg string) {
+	user := CurrentUser(r)
+	set, err := HasSyncPassword(db, user.ID)
+	if err != nil {
+		http.Error(w, "Unable to load sync settings", http.StatusInternalServerError)
+		env.Logger.Error("Error loading sync settings", "err", err)
+		return
+	}
+	templ.Handler(ui.KosyncSettings(AbsoluteURL(r, kosyncPrefix), user.Username, set, message, errMsg)).ServeHTTP(w, r)
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/parthshahp/booknotes/internal/db"
+)
+
+// bookLabels is one of the user's own lists of names books are filed
+// under: tags and collections.
+type bookLabels struct {
+	table  string
+	links  string
+	column string
+}
+
+var (
+	tagLabels        = bookLabels{table: "tags", links: "book_tags", column: "tag_id"}
+	collectionLabels = bookLabels{table: "collections", links: "collection_books", column: "collection_id"}
+)
+
+// selectSQL selects the names on the book aliased as b as a JSON array,
+// read with decodeNames.
+func (l bookLabels) selectSQL() string {
+	return fmt.Sprintf(`(SELECT json_group_array(x.name ORDER BY x.name COLLATE NOCASE)
+      FROM %s bx JOIN %s x ON bx.%s = x.id WHERE bx.book_id = b.id)`, l.links, l.table, l.column)
+}
+
+// set files the user's book under exactly names, creating the ones the
+// user doesn't have yet and dropping the ones no book uses any more.
+func (l bookLabels) set(db *db.DB, userID int, bookID string, names []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var owned bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM books WHERE id = ? AND user_id = ?);`, bookID, userID).
+		Scan(&owned); err != nil {
+		return err
+	}
+	if !owned {
+		return sql.ErrNoRows
+	}
+
+	if _, err := tx.Exec(`DELETE FROM `+l.links+` WHERE book_id = ?;`, bookID); err != nil {
+		return err
+	}
+	for _, name := range names {
+		_, err := tx.Exec(`INSERT INTO `+l.table+` (user_id, name) VALUES (?, ?) ON CONFLICT (user_id, name) DO NOTHING;`,
+			userID, name)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+      INSERT OR IGNORE INTO `+l.links+` (book_id, `+l.column+`)
+      SELECT ?, id FROM `+l.table+` WHERE user_id = ? AND name = ?;
+    `, bookID, userID, name)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`
+    DELETE FROM `+l.table+`
+    WHERE user_id = ? AND id NOT IN (SELECT `+l.column+` FROM `+l.links+`);
+  `, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,372 @@
+package api
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parthshahp/booknotes/internal/db"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+const (
+	FormatMarkdown = "md"
+	FormatJSON     = "json"
+	FormatCSV      = "csv"
+	FormatAnki     = "anki"
+)
+
+// IsExportFormat reports whether format is one WriteBook can write.
+func IsExportFormat(format string) bool {
+	switch format {
+	case FormatMarkdown, FormatJSON, FormatCSV, FormatAnki:
+		return true
+	}
+	return false
+}
+
+// FormatExt is the file extension for books exported in format.
+func FormatExt(format string) string {
+	if format == FormatAnki {
+		return ".txt"
+	}
+	return "." + format
+}
+
+// LibraryFilter narrows a library export. Empty fields match every book and
+// the date range applies to the book's created on date.
+type LibraryFilter struct {
+	Collection string
+	Tag        string
+	Author     string
+	From       time.Time
+	To         time.Time
+}
+
+type LibraryManifest struct {
+	Version    int                   `json:"version"`
+	ExportedOn time.Time             `json:"exported_on"`
+	Format     string                `json:"format"`
+	Filter     map[string]string     `json:"filter,omitempty"`
+	Books      []LibraryManifestBook `json:"books"`
+}
+
+type LibraryManifestBook struct {
+	ID         int      `json:"id"`
+	Title      string   `json:"title"`
+	Authors    []string `json:"authors"`
+	EntryCount int      `json:"entry_count"`
+	File       string   `json:"file"`
+}
+
+// ParseLibraryFilter reads collection, tag, author, from and to from a
+// query string. Dates use the 2006-01-02 layout and the range is inclusive.
+func ParseLibraryFilter(query url.Values) (LibraryFilter, error) {
+	filter := LibraryFilter{
+		Collection: query.Get("collection"),
+		Tag:        query.Get("tag"),
+		Author:     query.Get("author"),
+	}
+
+	if from := query.Get("from"); from != "" {
+		t, err := time.ParseInLocation("2006-01-02", from, time.Local)
+		if err != nil {
+			return filter, fmt.Errorf("invalid from date %q", from)
+		}
+		filter.From = t
+	}
+	if to := query.Get("to"); to != "" {
+		t, err := time.ParseInLocation("2006-01-02", to, time.Local)
+		if err != nil {
+			return filter, fmt.Errorf("invalid to date %q", to)
+		}
+		filter.To = t.AddDate(0, 0, 1)
+	}
+
+	return filter, nil
+}
+
+// GetLibraryBookIDs returns the ids of every book matching filter, oldest
+// first.
+func GetLibraryBookIDs(db *db.DB, env *Env, userID int, filter LibraryFilter) ([]int, error) {
+	conditions, args := filter.where(userID)
+
+	query := `SELECT b.id FROM books b WHERE ` + strings.Join(conditions, ` AND `) + ` ORDER BY b.created_on, b.id;`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		env.Logger.Error("Failed to query library", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			env.Logger.Error("Failed to scan book id", "err", err)
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+func ExportLibrary(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving export library")
+		query := r.URL.Query()
+
+		format := query.Get("format")
+		if format == "" {
+			format = FormatMarkdown
+		}
+		if !IsExportFormat(format) {
+			http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+			return
+		}
+
+		opts, err := ParseExportOptions(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter, err := ParseLibraryFilter(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user := CurrentUser(r)
+		ids, err := GetLibraryBookIDs(db, env, user.ID, filter)
+		if err != nil {
+			http.Error(w, "Unable to load library", http.StatusInternalServerError)
+			return
+		}
+
+		name := "booknotes-" + time.Now().Format("2006-01-02")
+		w.Header().Set("Content-Disposition", ContentDisposition(name, ".zip"))
+		w.Header().Set("Content-Type", "application/zip")
+
+		// The archive is streamed, so failures past this point can only be
+		// logged and leave a truncated zip behind
+		if err := WriteLibraryZip(w, db, env, user.ID, ids, format, opts, filter); err != nil {
+			env.Logger.ErrorContext(r.Context(), "Error writing library export", "err", err)
+		}
+	})
+}
+
+// WriteLibraryZip writes one file per book plus a manifest.json to w. Books
+// are loaded one at a time so the library never sits fully in memory.
+func WriteLibraryZip(
+	w io.Writer,
+	db *db.DB,
+	env *Env,
+	userID int,
+	ids []int,
+	format string,
+	opts ExportOptions,
+	filter LibraryFilter,
+) error {
+	zw := zip.NewWriter(w)
+
+	manifest := LibraryManifest{
+		Version:    1,
+		ExportedOn: time.Now(),
+		Format:     format,
+		Filter:     filter.values(),
+	}
+
+	for _, id := range ids {
+		data, err := GetExportBook(db, env, userID, strconv.Itoa(id), opts)
+		if err != nil {
+			return err
+		}
+
+		file := fmt.Sprintf("books/%d-%s%s", id, slugify(data.Book.Title), FormatExt(format))
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     file,
+			Method:   zip.Deflate,
+			Modified: data.ExportedOn,
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := WriteBook(fw, data, format, opts); err != nil {
+			return err
+		}
+
+		manifest.Books = append(manifest.Books, LibraryManifestBook{
+			ID:         data.Book.ID,
+			Title:      data.Book.Title,
+			Authors:    data.Authors,
+			EntryCount: data.Book.EntryCount,
+			File:       file,
+		})
+	}
+
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     "manifest.json",
+		Method:   zip.Deflate,
+		Modified: manifest.ExportedOn,
+	})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(fw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// WriteBook writes one book in format.
+func WriteBook(w io.Writer, data ExportBook, format string, opts ExportOptions) error {
+	switch format {
+	case FormatMarkdown:
+		_, err := io.WriteString(w, RenderMarkdown(data, opts))
+		return err
+	case FormatJSON:
+		return writeBookJSON(w, data)
+	case FormatCSV:
+		return writeBookCSV(w, data)
+	case FormatAnki:
+		return writeBookAnki(w, data)
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// writeBookJSON writes the book in the same shape accepted by
+// POST /import/json, so exported files can be imported again.
+func writeBookJSON(w io.Writer, data ExportBook) error {
+	book := BookImport{
+		EpochCreatedOn: data.Book.TimeCreatedOn.Unix(),
+		NumberOfPages:  data.Book.NumberOfPages,
+		Title:          data.Book.Title,
+		Entries:        data.Entries,
+		Author:         strings.Join(data.Authors, "\n"),
+		MD5:            data.Book.MD5,
+	}
+	if book.Entries == nil {
+		book.Entries = []Entry{}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(book)
+}
+
+func writeBookCSV(w io.Writer, data ExportBook) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"book_id", "title", "authors", "chapter", "page", "highlighted_on", "text", "note"})
+	for _, entry := range data.Entries {
+		cw.Write([]string{
+			strconv.Itoa(data.Book.ID),
+			data.Book.Title,
+			strings.Join(data.Authors, "; "),
+			entry.Chapter,
+			strconv.Itoa(entry.Page),
+			time.Unix(entry.Time, 0).Format(time.RFC3339),
+			entry.Text,
+			entry.Note,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeBookAnki writes a tab separated file for Anki's text importer, with
+// the highlight on the front of each card and the note and source on the
+// back. The header lines tell Anki how to read the columns.
+func writeBookAnki(w io.Writer, data ExportBook) error {
+	fmt.Fprintln(w, "#separator:tab")
+	fmt.Fprintln(w, "#html:false")
+	fmt.Fprintln(w, "#tags column:3")
+
+	source := data.Book.Title
+	if len(data.Authors) > 0 {
+		source += " by " + strings.Join(data.Authors, ", ")
+	}
+	tag := slugify(data.Book.Title)
+
+	cw := csv.NewWriter(w)
+	cw.Comma = '\t'
+	for _, entry := range data.Entries {
+		back := fmt.Sprintf("%s, page %d", source, entry.Page)
+		if entry.Note != "" {
+			back = entry.Note + "\n\n" + back
+		}
+		cw.Write([]string{entry.Text, back, tag})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// where returns the SQL conditions, on books aliased as b, matching the
+// user's books that pass the filter, and their arguments.
+func (f LibraryFilter) where(userID int) ([]string, []any) {
+	conditions := []string{`b.user_id = ?`}
+	args := []any{userID}
+
+	if f.Collection != "" {
+		conditions = append(conditions, `EXISTS (
+      SELECT 1 FROM collection_books cb
+      JOIN collections c ON cb.collection_id = c.id
+      WHERE cb.book_id = b.id AND c.name = ?)`)
+		args = append(args, f.Collection)
+	}
+	if f.Tag != "" {
+		conditions = append(conditions, `EXISTS (
+      SELECT 1 FROM book_tags bt
+      JOIN tags t ON bt.tag_id = t.id
+      WHERE bt.book_id = b.id AND t.name = ?)`)
+		args = append(args, f.Tag)
+	}
+	if f.Author != "" {
+		conditions = append(conditions, `EXISTS (
+      SELECT 1 FROM book_authors ba
+      JOIN authors a ON ba.author_id = a.id
+      WHERE ba.book_id = b.id AND a.name = ?)`)
+		args = append(args, f.Author)
+	}
+	if !f.From.IsZero() {
+		conditions = append(conditions, `b.created_on >= ?`)
+		args = append(args, f.From.Unix())
+	}
+	if !f.To.IsZero() {
+		conditions = append(conditions, `b.created_on < ?`)
+		args = append(args, f.To.Unix())
+	}
+	return conditions, args
+}
+
+func (f LibraryFilter) values() map[string]string {
+	values := map[string]string{}
+	if f.Collection != "" {
+		values["collection"] = f.Collection
+	}
+	if f.Tag != "" {
+		values["tag"] = f.Tag
+	}
+	if f.Author != "" {
+		values["author"] = f.Author
+	}
+	if !f.From.IsZero() {
+		values["from"] = f.From.Format("2006-01-02")
+	}
+	if !f.To.IsZero() {
+		values["to"] = f.To.AddDate(0, 0, -1).Format("2006-01-02")
+	}
+	return values
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/parthshahp/booknotes/internal/db"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+// TestLibraryExportJSON checks the JSON files in a library export can be
+// imported again, keeping the book's md5 so KOReader syncs still match.
+func TestLibraryExportJSON(t *testing.T) {
+	database, err := db.OpenDB(filepath.Join(t.TempDir(), "booknotes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.CloseDB() })
+	if err := database.InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	env := &Env{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	user, err := insertUser(database, env, "admin", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := BookImport{
+		EpochCreatedOn: 1700000000,
+		NumberOfPages:  320,
+		Title:          "Dune",
+		Author:         "Frank Herbert",
+		MD5:            "0123456789abcdef0123456789abcdef",
+		Entries:        []Entry{{Time: 1700000100, Page: 12, Chapter: "Book One", Text: "Fear is the mind-killer."}},
+	}
+	if _, err := ImportBook(imported, database, env, user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := GetLibraryBookIDs(database, env, user.ID, LibraryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	opts := ExportOptions{Order: OrderReading, Group: GroupChapter}
+	if err := WriteLibraryZip(&buf, database, env, user.ID, ids, FormatJSON, opts, LibraryFilter{}); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var books []BookImport
+	for _, f := range zr.File {
+		if f.Name == "manifest.json" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var book BookImport
+		err = json.NewDecoder(rc).Decode(&book)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+		books = append(books, book)
+	}
+
+	if len(books) != 1 {
+		t.Fatalf("exported %d books, want 1", len(books))
+	}
+	got := books[0]
+	if got.Title != imported.Title || got.Author != imported.Author {
+		t.Errorf("exported %q by %q, want %q by %q", got.Title, got.Author, imported.Title, imported.Author)
+	}
+	if got.MD5 != imported.MD5 {
+		t.Errorf("exported md5 = %q, want %q", got.MD5, imported.MD5)
+	}
+	if len(got.Entries) != 1 || got.Entries[0].Text != imported.Entries[0].Text {
+		t.Errorf("exported entries = %+v, want %+v", got.Entries, imported.Entries)
+	}
+}
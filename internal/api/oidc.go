@@ -0,0 +1,306 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	ui "github.com/parthshahp/booknotes/components"
+	"github.com/parthshahp/booknotes/internal/basepath"
+	"github.com/parthshahp/booknotes/internal/db"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+// oidcCookie holds the state, nonce and PKCE verifier of a login in flight
+const oidcCookie = "booknotes_oidc"
+
+var ErrNotInGroup = errors.New("your account is not allowed to use booknotes")
+
+// OIDCClient signs users in through an OpenID Connect provider. Discovery
+// happens on first use so the server still starts while the provider is
+// unreachable.
+type OIDCClient struct {
+	cfg OIDCConfig
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+// NewOIDCClient returns nil when single sign-on is not configured.
+func NewOIDCClient(cfg OIDCConfig) *OIDCClient {
+	if cfg.Issuer == "" {
+		return nil
+	}
+	return &OIDCClient{cfg: cfg}
+}
+
+func (c *OIDCClient) discover(ctx context.Context) (*oidc.Provider, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.provider != nil {
+		return c.provider, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, c.cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	c.provider = provider
+	return provider, nil
+}
+
+func (c *OIDCClient) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     c.cfg.ClientID,
+		ClientSecret: c.cfg.ClientSecret,
+		RedirectURL:  c.cfg.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       c.cfg.Scopes,
+	}
+}
+
+// oidcClaims are the ID token claims used to find or create the account.
+type oidcClaims struct {
+	Subject           string
+	PreferredUsername string
+	Email             string
+	Groups            []string
+}
+
+// Exchange trades the authorization code for tokens and verifies the ID
+// token's signature, audience, expiry and nonce.
+func (c *OIDCClient) Exchange(ctx context.Context, code, verifier, nonce string) (oidcClaims, error) {
+	provider, err := c.discover(ctx)
+	if err != nil {
+		return oidcClaims{}, err
+	}
+
+	token, err := c.oauth2Config(provider).Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return oidcClaims{}, fmt.Errorf("exchange code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return oidcClaims{}, errors.New("token response has no id_token")
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: c.cfg.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return oidcClaims{}, fmt.Errorf("verify id token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return oidcClaims{}, errors.New("id token nonce does not match")
+	}
+
+	var raw map[string]any
+	if err := idToken.Claims(&raw); err != nil {
+		return oidcClaims{}, err
+	}
+	claims := oidcClaims{Subject: idToken.Subject}
+	claims.PreferredUsername, _ = raw["preferred_username"].(string)
+	claims.Email, _ = raw["email"].(string)
+
+	// Providers send groups as a list, or as a single string when there's one
+	switch groups := raw[c.cfg.GroupsClaim].(type) {
+	case string:
+		claims.Groups = []string{groups}
+	case []any:
+		for _, group := range groups {
+			if s, ok := group.(string); ok {
+				claims.Groups = append(claims.Groups, s)
+			}
+		}
+	}
+	return claims, nil
+}
+
+// Role maps the user's groups to a role. An empty role means the groups
+// don't decide it and the account keeps its current role.
+func (c *OIDCClient) Role(groups []string) (string, error) {
+	inAny := func(allowed []string) bool {
+		for _, group := range groups {
+			if slices.Contains(allowed, group) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(c.cfg.AdminGroups) > 0 && inAny(c.cfg.AdminGroups) {
+		return RoleAdmin, nil
+	}
+	if len(c.cfg.UserGroups) > 0 && !inAny(c.cfg.UserGroups) {
+		return "", ErrNotInGroup
+	}
+	if len(c.cfg.AdminGroups) > 0 {
+		return RoleUser, nil
+	}
+	return "", nil
+}
+
+// GetOIDCUser finds the account linked to the provider's subject, creating
+// it on first sign in, and applies the role from the user's groups.
+func GetOIDCUser(db *db.DB, env *Env, issuer string, claims oidcClaims, role string) (User, error) {
+	var user User
+	var createdOn int64
+	err := db.QueryRow(
+		`SELECT id, username, role, created_on FROM users WHERE oidc_issuer = ? AND oidc_subject = ?;`,
+		issuer, claims.Subject,
+	).Scan(&user.ID, &user.Username, &user.Role, &createdOn)
+	if err == sql.ErrNoRows {
+		return createOIDCUser(db, env, issuer, claims, role)
+	}
+	if err != nil {
+		env.Logger.Error("Failed to query oidc user", "err", err)
+		return User{}, err
+	}
+	user.CreatedOn = time.Unix(createdOn, 0)
+
+	if role != "" && role != user.Role {
+		if _, err := db.Exec(`UPDATE users SET role = ? WHERE id = ?;`, role, user.ID); err != nil {
+			env.Logger.Error("Failed to update role", "err", err)
+			return User{}, err
+		}
+		env.Logger.Info("Changed role", "user", user.Username, "role", role)
+		user.Role = role
+	}
+	return user, nil
+}
+
+// createOIDCUser adds the account for the provider's subject and links it
+// in one transaction, so a failed link never leaves an unlinked account or
+// the first account's claimed rows behind.
+func createOIDCUser(db *db.DB, env *Env, issuer string, claims oidcClaims, role string) (User, error) {
+	username := strings.TrimSpace(claims.PreferredUsername)
+	if username == "" {
+		username = strings.TrimSpace(claims.Email)
+	}
+	if username == "" {
+		username = claims.Subject
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	// Never link to an existing local account by name, that would let anyone
+	// who controls a provider account take it over. A taken name gets a
+	// suffix from the subject instead, the same on every attempt.
+	taken, err := usernameTaken(tx, username)
+	if err != nil {
+		return User{}, err
+	}
+	if taken {
+		username += "-" + hashToken(issuer + " " + claims.Subject)[:6]
+	}
+
+	user, err := createUser(tx, env, username, "", role)
+	if err != nil {
+		return User{}, err
+	}
+	if _, err := tx.Exec(`UPDATE users SET oidc_issuer = ?, oidc_subject = ? WHERE id = ?;`,
+		issuer, claims.Subject, user.ID); err != nil {
+		return User{}, err
+	}
+	return user, tx.Commit()
+}
+
+func OIDCLogin(env *Env, client *OIDCClient) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving oidc login")
+		provider, err := client.discover(r.Context())
+		if err != nil {
+			env.Logger.ErrorContext(r.Context(), "Error discovering oidc provider", "err", err)
+			http.Error(w, "Single sign-on is unavailable", http.StatusBadGateway)
+			return
+		}
+
+		state, err := randomToken(16)
+		if err != nil {
+			http.Error(w, "Unable to start login", http.StatusInternalServerError)
+			return
+		}
+		nonce, err := randomToken(16)
+		if err != nil {
+			http.Error(w, "Unable to start login", http.StatusInternalServerError)
+			return
+		}
+		verifier := oauth2.GenerateVerifier()
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcCookie,
+			Value:    strings.Join([]string{state, nonce, verifier}, "."),
+			Path:     basepath.URL(r.Context(), "/auth/oidc"),
+			MaxAge:   int((10 * time.Minute).Seconds()),
+			HttpOnly: true,
+			Secure:   env.Auth.SecureCookies || isHTTPS(r),
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		url := client.oauth2Config(provider).AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+		http.Redirect(w, r, url, http.StatusFound)
+	})
+}
+
+func OIDCCallback(env *Env, db *db.DB, client *OIDCClient) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving oidc callback")
+		loginError := func(status int, msg string) {
+			w.WriteHeader(status)
+			templ.Handler(ui.LoginPage(msg, env.Auth.AllowSignup, ssoLabel(env))).ServeHTTP(w, r)
+		}
+
+		cookie, err := r.Cookie(oidcCookie)
+		if err != nil {
+			loginError(http.StatusBadRequest, "Sign in expired, please try again")
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: basepath.URL(r.Context(), "/auth/oidc"), MaxAge: -1})
+
+		parts := strings.Split(cookie.Value, ".")
+		query := r.URL.Query()
+		if len(parts) != 3 || query.Get("state") != parts[0] {
+			loginError(http.StatusBadRequest, "Sign in expired, please try again")
+			return
+		}
+		if e := query.Get("error"); e != "" {
+			env.Logger.ErrorContext(r.Context(), "OIDC provider returned an error", "error", e, "description", query.Get("error_description"))
+			loginError(http.StatusUnauthorized, "Sign in was cancelled or refused")
+			return
+		}
+
+		claims, err := client.Exchange(r.Context(), query.Get("code"), parts[2], parts[1])
+		if err != nil {
+			env.Logger.ErrorContext(r.Context(), "Error completing oidc login", "err", err)
+			loginError(http.StatusUnauthorized, "Unable to sign in with single sign-on")
+			return
+		}
+
+		role, err := client.Role(claims.Groups)
+		if err != nil {
+			loginError(http.StatusForbidden, err.Error())
+			return
+		}
+
+		user, err := GetOIDCUser(db, env, client.cfg.Issuer, claims, role)
+		if err != nil {
+			env.Logger.ErrorContext(r.Context(), "Error loading oidc user", "err", err)
+			loginError(http.StatusForbidden, "Unable to sign in: "+err.Error())
+			return
+		}
+
+		startSession(w, r, env, db, user)
+	})
+}
@@ -0,0 +1,471 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+
+	"github.com/parthshahp/booknotes/internal/db"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+const (
+	stubClientID     = "booknotes"
+	stubClientSecret = "secret"
+	stubKeyID        = "stub-key"
+)
+
+// oidcStub is an OpenID Connect provider serving discovery, JWKS and token
+// endpoints. Tests stand in for the browser: authorize hands out a code as
+// the provider's login page would.
+type oidcStub struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]stubGrant
+}
+
+// stubGrant is what the provider remembers about an authorization code.
+type stubGrant struct {
+	challenge string
+	nonce     string
+	claims    map[string]any
+}
+
+func newOIDCStub(t *testing.T) *oidcStub {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &oidcStub{t: t, key: key, grants: map[string]stubGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"issuer":                                s.URL,
+			"authorization_endpoint":                s.URL + "/authorize",
+			"token_endpoint":                        s.URL + "/token",
+			"jwks_uri":                              s.URL + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"code_challenge_methods_supported":      []string{"S256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: stubKeyID, Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("POST /token", s.token)
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// authorize signs the user in at the provider for the login that sent them
+// to authURL and returns the code the provider redirects back with. nonce
+// replaces the login's nonce in the ID token when set.
+func (s *oidcStub) authorize(authURL string, claims map[string]any, nonce string) string {
+	s.t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	query := u.Query()
+	if got := query.Get("code_challenge_method"); got != "S256" {
+		s.t.Fatalf("code_challenge_method = %q, want S256", got)
+	}
+	if query.Get("code_challenge") == "" {
+		s.t.Fatal("login sent no PKCE code challenge")
+	}
+	if nonce == "" {
+		nonce = query.Get("nonce")
+	}
+
+	code, err := randomToken(16)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.grants[code] = stubGrant{challenge: query.Get("code_challenge"), nonce: nonce, claims: claims}
+	s.mu.Unlock()
+	return code
+}
+
+func (s *oidcStub) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if id != stubClientID || secret != stubClientSecret {
+		tokenError(w, "invalid_client")
+		return
+	}
+
+	s.mu.Lock()
+	grant, ok := s.grants[r.PostForm.Get("code")]
+	delete(s.grants, r.PostForm.Get("code"))
+	s.mu.Unlock()
+	if !ok || r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "invalid_grant")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]any{
+		"iss":   s.URL,
+		"aud":   stubClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"nonce": grant.nonce,
+	}
+	for k, v := range grant.claims {
+		claims[k] = v
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     s.sign(claims),
+	})
+}
+
+func (s *oidcStub) sign(claims map[string]any) string {
+	s.t.Helper()
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: s.key, KeyID: stubKeyID}},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	token, err := jws.CompactSerialize()
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return token
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+// oidcTest is a booknotes server half: a database, an environment and an
+// OIDC client pointed at a stub provider.
+type oidcTest struct {
+	t      *testing.T
+	stub   *oidcStub
+	env    *Env
+	db     *db.DB
+	client *OIDCClient
+}
+
+func newOIDCTest(t *testing.T, configure func(*OIDCConfig)) *oidcTest {
+	t.Helper()
+	stub := newOIDCStub(t)
+	cfg := OIDCConfig{
+		Issuer:       stub.URL,
+		ClientID:     stubClientID,
+		ClientSecret: stubClientSecret,
+		RedirectURL:  "http://booknotes.test/auth/oidc/callback",
+		Scopes:       []string{"openid", "profile", "email"},
+		GroupsClaim:  "groups",
+	}
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	database, err := db.OpenDB(filepath.Join(t.TempDir(), "booknotes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.CloseDB() })
+	if err := database.InitDB(); err != nil {
+		t.Fatal(err)
+	}
+
+	env := &Env{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Auth:   AuthConfig{SessionTTL: time.Hour, OIDC: cfg},
+	}
+	// Make the local admin so single sign-on accounts get their mapped role
+	if _, err := insertUser(database, env, "admin", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	return &oidcTest{t: t, stub: stub, env: env, db: database, client: NewOIDCClient(cfg)}
+}
+
+// login starts a sign in, returning the provider address it redirects to
+// and the cookie holding the state, nonce and PKCE verifier.
+func (o *oidcTest) login() (string, *http.Cookie) {
+	o.t.Helper()
+	rec := httptest.NewRecorder()
+	OIDCLogin(o.env, o.client)(rec, httptest.NewRequest(http.MethodGet, "/auth/oidc/login", nil))
+	if rec.Code != http.StatusFound {
+		o.t.Fatalf("login status = %d, want %d: %s", rec.Code, http.StatusFound, rec.Body)
+	}
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == oidcCookie {
+			return rec.Header().Get("Location"), cookie
+		}
+	}
+	o.t.Fatal("login set no oidc cookie")
+	return "", nil
+}
+
+// callback returns to booknotes from the provider.
+func (o *oidcTest) callback(code, state string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	o.t.Helper()
+	query := url.Values{"code": {code}, "state": {state}}
+	req := httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?"+query.Encode(), nil)
+	req.AddCookie(cookie)
+	rec := httptest.NewRecorder()
+	OIDCCallback(o.env, o.db, o.client)(rec, req)
+	return rec
+}
+
+// signIn runs a whole sign in as the provider user with claims.
+func (o *oidcTest) signIn(claims map[string]any) *httptest.ResponseRecorder {
+	o.t.Helper()
+	authURL, cookie := o.login()
+	code := o.stub.authorize(authURL, claims, "")
+	return o.callback(code, stateOf(o.t, authURL), cookie)
+}
+
+// user returns the account linked to the provider subject.
+func (o *oidcTest) user(subject string) (User, error) {
+	var user User
+	err := o.db.QueryRow(`SELECT id, username, role FROM users WHERE oidc_issuer = ? AND oidc_subject = ?;`,
+		o.stub.URL, subject).Scan(&user.ID, &user.Username, &user.Role)
+	return user, err
+}
+
+func stateOf(t *testing.T, authURL string) string {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query().Get("state")
+}
+
+func hasSession(rec *httptest.ResponseRecorder) bool {
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == sessionCookie && cookie.Value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestOIDCSignIn(t *testing.T) {
+	o := newOIDCTest(t, nil)
+
+	rec := o.signIn(map[string]any{"sub": "sub-1", "preferred_username": "alice"})
+	if rec.Code != http.StatusSeeOther || !hasSession(rec) {
+		t.Fatalf("sign in status = %d, session = %v: %s", rec.Code, hasSession(rec), rec.Body)
+	}
+	user, err := o.user("sub-1")
+	if err != nil {
+		t.Fatalf("no account linked to the subject: %v", err)
+	}
+	if user.Username != "alice" || user.Role != RoleUser {
+		t.Errorf("account = %q as %q, want alice as %q", user.Username, user.Role, RoleUser)
+	}
+
+	// Signing in again finds the same account
+	if rec := o.signIn(map[string]any{"sub": "sub-1", "preferred_username": "alice"}); !hasSession(rec) {
+		t.Fatalf("second sign in failed with %d: %s", rec.Code, rec.Body)
+	}
+	again, err := o.user("sub-1")
+	if err != nil || again.ID != user.ID {
+		t.Errorf("second sign in used account %d, want %d (%v)", again.ID, user.ID, err)
+	}
+}
+
+func TestOIDCPKCEMismatch(t *testing.T) {
+	o := newOIDCTest(t, nil)
+	authURL, cookie := o.login()
+	code := o.stub.authorize(authURL, map[string]any{"sub": "sub-1"}, "")
+
+	// Swap the verifier kept in the cookie for another one
+	parts := strings.Split(cookie.Value, ".")
+	parts[2] = "another-verifier-that-does-not-match-the-challenge"
+	cookie.Value = strings.Join(parts, ".")
+
+	rec := o.callback(code, stateOf(t, authURL), cookie)
+	if rec.Code != http.StatusUnauthorized || hasSession(rec) {
+		t.Fatalf("status = %d, session = %v, want %d without one", rec.Code, hasSession(rec), http.StatusUnauthorized)
+	}
+}
+
+func TestOIDCStateMismatch(t *testing.T) {
+	o := newOIDCTest(t, nil)
+	authURL, cookie := o.login()
+	code := o.stub.authorize(authURL, map[string]any{"sub": "sub-1"}, "")
+
+	rec := o.callback(code, "forged-state", cookie)
+	if rec.Code != http.StatusBadRequest || hasSession(rec) {
+		t.Fatalf("status = %d, session = %v, want %d without one", rec.Code, hasSession(rec), http.StatusBadRequest)
+	}
+	if _, err := o.user("sub-1"); err == nil {
+		t.Error("account created despite the state mismatch")
+	}
+}
+
+func TestOIDCNonceMismatch(t *testing.T) {
+	o := newOIDCTest(t, nil)
+	authURL, cookie := o.login()
+	code := o.stub.authorize(authURL, map[string]any{"sub": "sub-1"}, "replayed-nonce")
+
+	rec := o.callback(code, stateOf(t, authURL), cookie)
+	if rec.Code != http.StatusUnauthorized || hasSession(rec) {
+		t.Fatalf("status = %d, session = %v, want %d without one", rec.Code, hasSession(rec), http.StatusUnauthorized)
+	}
+	if _, err := o.user("sub-1"); err == nil {
+		t.Error("account created despite the nonce mismatch")
+	}
+}
+
+func TestOIDCGroupRoles(t *testing.T) {
+	o := newOIDCTest(t, func(cfg *OIDCConfig) {
+		cfg.AdminGroups = []string{"booknotes-admins"}
+		cfg.UserGroups = []string{"booknotes-users"}
+	})
+
+	tests := []struct {
+		subject string
+		groups  any
+		role    string
+		status  int
+	}{
+		{"admin", []string{"staff", "booknotes-admins"}, RoleAdmin, http.StatusSeeOther},
+		{"user", []string{"booknotes-users"}, RoleUser, http.StatusSeeOther},
+		// A lone group may come as a plain string
+		{"single", "booknotes-admins", RoleAdmin, http.StatusSeeOther},
+		{"outsider", []string{"staff"}, "", http.StatusForbidden},
+		{"nogroups", nil, "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.subject, func(t *testing.T) {
+			claims := map[string]any{"sub": tt.subject, "preferred_username": tt.subject}
+			if tt.groups != nil {
+				claims["groups"] = tt.groups
+			}
+			rec := o.signIn(claims)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+
+			user, err := o.user(tt.subject)
+			if tt.role == "" {
+				if err == nil {
+					t.Errorf("account created for a user in no allowed group")
+				}
+				if !strings.Contains(rec.Body.String(), ErrNotInGroup.Error()) {
+					t.Errorf("page doesn't say the account isn't allowed: %s", rec.Body)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Role != tt.role {
+				t.Errorf("role = %q, want %q", user.Role, tt.role)
+			}
+		})
+	}
+}
+
+func TestOIDCRole(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    OIDCConfig
+		groups []string
+		role   string
+		err    error
+	}{
+		{"no groups configured", OIDCConfig{}, []string{"anything"}, "", nil},
+		{"admin", OIDCConfig{AdminGroups: []string{"a"}}, []string{"x", "a"}, RoleAdmin, nil},
+		{"demoted admin", OIDCConfig{AdminGroups: []string{"a"}}, []string{"x"}, RoleUser, nil},
+		{"user group only", OIDCConfig{UserGroups: []string{"u"}}, []string{"u"}, "", nil},
+		{"admin outside user group", OIDCConfig{AdminGroups: []string{"a"}, UserGroups: []string{"u"}}, []string{"a"}, RoleAdmin, nil},
+		{"not in group", OIDCConfig{AdminGroups: []string{"a"}, UserGroups: []string{"u"}}, []string{"x"}, "", ErrNotInGroup},
+		{"no groups", OIDCConfig{UserGroups: []string{"u"}}, nil, "", ErrNotInGroup},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			role, err := (&OIDCClient{cfg: tt.cfg}).Role(tt.groups)
+			if !errors.Is(err, tt.err) || role != tt.role {
+				t.Errorf("Role(%v) = %q, %v, want %q, %v", tt.groups, role, err, tt.role, tt.err)
+			}
+		})
+	}
+}
+
+func TestOIDCTakenUsername(t *testing.T) {
+	o := newOIDCTest(t, nil)
+	local, err := insertUser(o.db, o.env, "alice", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := o.signIn(map[string]any{"sub": "sub-1", "preferred_username": "alice"})
+	if !hasSession(rec) {
+		t.Fatalf("sign in with a taken username failed with %d: %s", rec.Code, rec.Body)
+	}
+	user, err := o.user("sub-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("alice-%s", hashToken(o.stub.URL + " sub-1")[:6])
+	if user.ID == local.ID || user.Username != want {
+		t.Errorf("account = %d %q, want a new account %q", user.ID, user.Username, want)
+	}
+
+	// The local account stays unlinked
+	var linked bool
+	if err := o.db.QueryRow(`SELECT oidc_subject IS NOT NULL FROM users WHERE id = ?;`, local.ID).Scan(&linked); err != nil {
+		t.Fatal(err)
+	}
+	if linked {
+		t.Error("local account was linked to the provider")
+	}
+}
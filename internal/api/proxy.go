@@ -0,0 +1,108 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/parthshahp/booknotes/internal/basepath"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+type forwardedProtoKey struct{}
+
+// Mount serves next below env.HTTP.BasePath, stripping it from request
+// paths, and records the prefix links and redirects need. A trusted proxy
+// that strips its own prefix names it in X-Forwarded-Prefix, which goes in
+// front of the base path, and may report the scheme the client used in
+// X-Forwarded-Proto.
+func Mount(env *Env, next http.Handler) http.Handler {
+	base := env.HTTP.BasePath
+	var trusted []netip.Prefix
+	for _, proxy := range env.HTTP.TrustedProxies {
+		// Config validation has already rejected bad entries
+		if prefix, err := ParseTrustedProxy(proxy); err == nil {
+			trusted = append(trusted, prefix)
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		prefix := ""
+		if fromTrustedProxy(trusted, r) {
+			if p, ok := basepath.Clean(r.Header.Get("X-Forwarded-Prefix")); ok {
+				prefix = p
+			}
+			if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+				ctx = context.WithValue(ctx, forwardedProtoKey{}, proto)
+			}
+		}
+		ctx = basepath.With(ctx, prefix+base)
+
+		if base != "" {
+			rest, ok := strings.CutPrefix(r.URL.Path, base)
+			if !ok || (rest != "" && rest[0] != '/') {
+				http.NotFound(w, r)
+				return
+			}
+			if rest == "" {
+				target := prefix + base + "/"
+				if r.URL.RawQuery != "" {
+					target += "?" + r.URL.RawQuery
+				}
+				http.Redirect(w, r, target, http.StatusMovedPermanently)
+				return
+			}
+
+			stripped := new(url.URL)
+			*stripped = *r.URL
+			stripped.Path = rest
+			stripped.RawPath = strings.TrimPrefix(r.URL.RawPath, base)
+			r = r.WithContext(ctx)
+			r.URL = stripped
+		} else {
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func fromTrustedProxy(trusted []netip.Prefix, r *http.Request) bool {
+	if len(trusted) == 0 {
+		return false
+	}
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedProto is the scheme a trusted proxy received the request over,
+// or "" if there was no trusted proxy.
+func forwardedProto(r *http.Request) string {
+	proto, _ := r.Context().Value(forwardedProtoKey{}).(string)
+	return proto
+}
+
+// isHTTPS reports whether the user reached us over HTTPS, either directly or
+// through a trusted proxy that terminated TLS.
+func isHTTPS(r *http.Request) bool {
+	if proto := forwardedProto(r); proto != "" {
+		return proto == "https"
+	}
+	return r.TLS != nil
+}
+
+// Redirect is http.Redirect to a root-relative path under the base path.
+func Redirect(w http.ResponseWriter, r *http.Request, path string, code int) {
+	http.Redirect(w, r, basepath.URL(r.Context(), path), code)
+}
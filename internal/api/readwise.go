@@ -0,0 +1,161 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/parthshahp/booknotes/internal/db"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+// readwisePrefix is where the Readwise highlight API is mirrored. Apps that
+// push to Readwise can use booknotes by replacing https://readwise.io with
+// the booknotes address and sending an API token with the import scope.
+const readwisePrefix = "/api/v2"
+
+// Readwise files highlights without a title under Quotes
+const readwiseDefaultTitle = "Quotes"
+
+// readwiseHighlight is one highlight of a Readwise create request. Fields
+// booknotes has no use for, such as image_url or category, are ignored.
+type readwiseHighlight struct {
+	Text          string `json:"text"`
+	Title         string `json:"title"`
+	Author        string `json:"author"`
+	Note          string `json:"note"`
+	Location      int    `json:"location"`
+	LocationType  string `json:"location_type"`
+	HighlightedAt string `json:"highlighted_at"`
+}
+
+// readwiseBook is a book in the create response.
+type readwiseBook struct {
+	ID                 int64   `json:"id"`
+	Title              string  `json:"title"`
+	Author             string  `json:"author"`
+	Category           string  `json:"category"`
+	NumHighlights      int     `json:"num_highlights"`
+	ModifiedHighlights []int64 `json:"modified_highlights"`
+}
+
+// readwiseImports groups the highlights into one import per title and
+// author, keeping the books in the order they first appear.
+func readwiseImports(highlights []readwiseHighlight) ([]BookImport, error) {
+	var books []BookImport
+	index := map[[2]string]int{}
+	now := time.Now()
+	for _, h := range highlights {
+		if strings.TrimSpace(h.Text) == "" {
+			return nil, errReadwise("text", "This field may not be blank.")
+		}
+
+		title := strings.TrimSpace(h.Title)
+		if title == "" {
+			title = readwiseDefaultTitle
+		}
+		author := strings.TrimSpace(h.Author)
+
+		highlightedAt := now
+		if h.HighlightedAt != "" {
+			t, err := time.Parse(time.RFC3339, h.HighlightedAt)
+			if err != nil {
+				return nil, errReadwise("highlighted_at", "Datetime has wrong format. Use ISO 8601.")
+			}
+			highlightedAt = t
+		}
+
+		// Only page locations mean anything here, the rest are positions in
+		// the app's own rendering of the book
+		entry := Entry{Time: highlightedAt.Unix(), Text: h.Text, Note: h.Note}
+		if h.LocationType == "" || h.LocationType == "page" {
+			entry.Page = h.Location
+		}
+
+		key := [2]string{title, author}
+		i, ok := index[key]
+		if !ok {
+			i = len(books)
+			index[key] = i
+			books = append(books, BookImport{EpochCreatedOn: now.Unix(), Title: title, Author: author})
+		}
+		books[i].Entries = append(books[i].Entries, entry)
+	}
+	return books, nil
+}
+
+// readwiseError is a validation error in the shape Readwise sends.
+type readwiseError map[string][]string
+
+func (e readwiseError) Error() string {
+	for field, msgs := range e {
+		return field + ": " + strings.Join(msgs, " ")
+	}
+	return "invalid request"
+}
+
+func errReadwise(field, msg string) readwiseError {
+	return readwiseError{field: {msg}}
+}
+
+// ReadwiseAuth answers the token check apps make before syncing. The token
+// itself is checked by RequireToken.
+func ReadwiseAuth(env *Env) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving readwise auth")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func ReadwiseHighlights(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving readwise highlights")
+		var body struct {
+			Highlights []readwiseHighlight `json:"highlights"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, errReadwise("highlights", "Unable to parse json."))
+			env.Logger.ErrorContext(r.Context(), "Error parsing json", "err", err)
+			return
+		}
+
+		books, err := readwiseImports(body.Highlights)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, err)
+			return
+		}
+
+		user := CurrentUser(r)
+		res := []readwiseBook{}
+		for _, book := range books {
+			result, err := ImportBook(book, db, env, user.ID)
+			if err != nil {
+				http.Error(w, "Unable to insert data", http.StatusInternalServerError)
+				env.Logger.ErrorContext(r.Context(), "Error inserting data", "err", err)
+				return
+			}
+
+			var count int
+			if err := db.QueryRow(`SELECT COUNT(*) FROM entries WHERE book_id = ?;`, result.BookID).Scan(&count); err != nil {
+				http.Error(w, "Unable to load book", http.StatusInternalServerError)
+				env.Logger.ErrorContext(r.Context(), "Error counting entries", "err", err)
+				return
+			}
+
+			modified := result.EntryIDs
+			if modified == nil {
+				modified = []int64{}
+			}
+			res = append(res, readwiseBook{
+				ID:                 result.BookID,
+				Title:              book.Title,
+				Author:             book.Author,
+				Category:           "books",
+				NumHighlights:      count,
+				ModifiedHighlights: modified,
+			})
+		}
+		writeJSON(w, http.StatusOK, res)
+	})
+}
@@ -2,65 +2,198 @@ package api
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/parthshahp/booknotes/assets"
+	"github.com/parthshahp/booknotes/internal/basepath"
 	"github.com/parthshahp/booknotes/internal/db"
+	"github.com/parthshahp/booknotes/internal/jobs"
+	"github.com/parthshahp/booknotes/internal/logging"
+	"github.com/parthshahp/booknotes/internal/metrics"
 	. "github.com/parthshahp/booknotes/internal/types"
 )
 
-func RoutesInit(env *Env, db *db.DB) http.Handler {
-	env.InfoLog.Println("Serving routes")
+func RoutesInit(env *Env, db *db.DB, queue *jobs.Queue) http.Handler {
+	env.Logger.Debug("Serving routes")
+	queue.Handle(JobImport, RunImportJob(env, db))
+	queue.HandleFailure(JobImport, FailImportJob(env, db))
+
 	mux := http.NewServeMux()
-	fs := http.FileServer(http.Dir("./assets"))
-	mux.Handle("/assets/", http.StripPrefix("/assets", fs))
-
-	mux.HandleFunc("/", Index(env, db))
-	mux.HandleFunc("GET /table", Table(env, db))
-	mux.HandleFunc("POST /table/search", SearchBookTable(env, db))
-	mux.HandleFunc("GET /import", ImportPage(env))
-	mux.HandleFunc("POST /import/file", ImportFile(env, db))
-	mux.HandleFunc("POST /import/json", ImportJson(env, db))
-
-	mux.HandleFunc("POST /book/{id}", EditBook(env, db))
-	mux.HandleFunc("DELETE /book/{id}", DeleteBook(env, db))
-	mux.HandleFunc("GET /book/{id}/highlights", GetHighlights(env, db))
-
-	mux.HandleFunc("GET /highlights", SearchHighlightsPage(env, db))
-	mux.HandleFunc("POST /highlights/search", SearchHighlights(env, db))
-	mux.HandleFunc("POST /highlights/edit/{id}", EditHighlight(env, db))
-	mux.HandleFunc("DELETE /highlights/edit/{id}", DeleteHighlight(env, db))
-	mux.HandleFunc("GET /handleExport/{type}/{id}", Export(env))
-	mux.HandleFunc("GET /export/markdown/{id}", ExportMarkdown(env, db))
-
-	return logger(mux)
+	mux.Handle("GET /assets/", http.StripPrefix("/assets", assets.Handler()))
+	mux.HandleFunc("GET /healthz", Healthz(env))
+	mux.HandleFunc("GET /readyz", Readyz(env, db))
+	if env.Metrics.Enabled {
+		metrics.WatchLibrary(db.DB)
+		mux.Handle("GET /metrics", metrics.Handler(env.Metrics.Token))
+	}
+
+	sameOrigin := RequireSameOrigin(env)
+	mux.HandleFunc("GET /login", LoginPage(env, db))
+	mux.Handle("POST /login", sameOrigin(Login(env, db)))
+	mux.Handle("POST /logout", sameOrigin(Logout(env, db)))
+	mux.HandleFunc("GET /register", RegisterPage(env, db))
+	mux.Handle("POST /register", sameOrigin(Register(env, db)))
+	mux.HandleFunc("GET /s/{token}", SharedHighlights(env, db))
+
+	// KOReader progress sync authenticates with its own headers
+	syncUser := RequireSyncUser(env, db)
+	mux.HandleFunc("POST "+kosyncPrefix+"/users/create", KosyncRegister(env))
+	mux.Handle("GET "+kosyncPrefix+"/users/auth", syncUser(KosyncAuthorize(env)))
+	mux.Handle("PUT "+kosyncPrefix+"/syncs/progress", syncUser(KosyncUpdateProgress(env, db)))
+	mux.Handle("GET "+kosyncPrefix+"/syncs/progress/{document}", syncUser(KosyncGetProgress(env, db)))
+	mux.HandleFunc("GET "+kosyncPrefix+"/healthcheck", KosyncHealthcheck())
+	if oidc := NewOIDCClient(env.Auth.OIDC); oidc != nil {
+		mux.HandleFunc("GET /auth/oidc/login", OIDCLogin(env, oidc))
+		mux.HandleFunc("GET /auth/oidc/callback", OIDCCallback(env, db, oidc))
+	}
+
+	// Everything else needs a session, and a CSRF token to change anything
+	user := RequireUser(env, db)
+	admin := RequireAdmin(env, db)
+
+	// JSON endpoints take API tokens, the ones the UI links to also sessions
+	read := RequireTokenOrSession(env, db, ScopeRead, user)
+	adminAPI := RequireTokenOrSession(env, db, ScopeAdmin, admin)
+
+	mux.Handle("/", user(Index(env, db)))
+	mux.Handle("GET /table", user(Table(env, db)))
+	mux.Handle("GET /table/search", user(SearchBookTable(env, db)))
+	mux.Handle("GET /import", user(ImportPage(env, db, queue)))
+	mux.Handle("POST /import/file", user(ImportFile(env, db, queue)))
+	mux.Handle("GET /import/jobs/{id}", user(ImportJobStatus(env, db, queue)))
+	mux.Handle("GET /imports", user(ImportHistoryPage(env, db)))
+	mux.Handle("POST /import/json", RequireToken(env, db, ScopeImport)(ImportJson(env, db)))
+
+	// Readwise clients differ on the trailing slash
+	importAPI := RequireToken(env, db, ScopeImport)
+	for _, slash := range []string{"/{$}", ""} {
+		mux.Handle("GET "+readwisePrefix+"/auth"+slash, importAPI(ReadwiseAuth(env)))
+		mux.Handle("POST "+readwisePrefix+"/highlights"+slash, importAPI(ReadwiseHighlights(env, db)))
+	}
+
+	// KOReader's Joplin exporter, see joplin.go
+	joplin := RequireJoplinToken(env, db)
+	mux.HandleFunc("GET /ping", JoplinPing())
+	mux.Handle("GET /folders", joplin(JoplinFolders(env)))
+	mux.Handle("POST /folders", joplin(JoplinCreateFolder(env)))
+	mux.Handle("GET /search", joplin(JoplinSearch(env, db)))
+	mux.Handle("GET /notes", joplin(JoplinNotes(env, db)))
+	mux.Handle("POST /notes", joplin(JoplinCreateNote(env, db)))
+	mux.Handle("PUT /notes/{id}", joplin(JoplinUpdateNote(env, db)))
+
+	mux.Handle("POST /book/{id}", user(EditBook(env, db)))
+	mux.Handle("DELETE /book/{id}", user(DeleteBook(env, db)))
+	mux.Handle("GET /book/{id}/highlights", user(GetHighlights(env, db)))
+	mux.Handle("POST /book/{id}/share", user(ShareBook(env, db)))
+	mux.Handle("GET /authors", user(AuthorsPage(env, db)))
+	mux.Handle("GET /authors/{id}", user(AuthorPage(env, db)))
+	mux.Handle("POST /authors/{id}", user(EditAuthor(env, db)))
+	mux.Handle("POST /authors/{id}/merge", user(MergeAuthor(env, db)))
+	mux.Handle("GET /shares", user(SharesPage(env, db)))
+	mux.Handle("DELETE /shares/{id}", user(RevokeShare(env, db)))
+
+	mux.Handle("GET /highlights", user(SearchHighlightsPage(env, db)))
+	mux.Handle("POST /highlights/search", user(SearchHighlights(env, db)))
+	mux.Handle("POST /highlights/edit/{id}", user(EditHighlight(env, db)))
+	mux.Handle("DELETE /highlights/edit/{id}", user(DeleteHighlight(env, db)))
+	mux.Handle("GET /handleExport/{type}/{id}", user(Export(env)))
+	mux.Handle("GET /export/markdown/{id}", read(ExportMarkdown(env, db)))
+	mux.Handle("GET /export/library", read(ExportLibrary(env, db)))
+	mux.Handle("GET /backup/json", adminAPI(BackupJson(env, db)))
+	mux.Handle("POST /restore/json", adminAPI(RestoreJson(env, db)))
+
+	mux.Handle("GET /admin/backups", admin(BackupsPage(env, db)))
+	mux.Handle("POST /admin/backups", admin(CreateBackup(env, db)))
+	mux.Handle("GET /admin/backups/{name}", admin(DownloadBackup(env, db)))
+	mux.Handle("POST /admin/backups/{name}/verify", admin(VerifyBackup(env, db)))
+	mux.Handle("POST /admin/backups/{name}/restore", admin(RestoreBackup(env, db)))
+
+	mux.Handle("GET /templates", user(TemplatesPage(env, db)))
+	mux.Handle("POST /templates", user(SaveTemplate(env, db)))
+	mux.Handle("POST /templates/preview", user(PreviewTemplate(env, db)))
+	mux.Handle("GET /templates/{id}", user(EditTemplate(env, db)))
+	mux.Handle("DELETE /templates/{id}", user(DeleteTemplate(env, db)))
+
+	mux.Handle("GET /settings/tokens", user(TokensPage(env, db)))
+	mux.Handle("POST /settings/tokens", user(CreateToken(env, db)))
+	mux.Handle("DELETE /settings/tokens/{id}", user(RevokeToken(env, db)))
+	mux.Handle("GET /settings/kosync", user(KosyncSettingsPage(env, db)))
+	mux.Handle("POST /settings/kosync", user(SaveKosyncSettings(env, db)))
+
+	return Mount(env, StrictTransportSecurity(env)(logger(env, mux)))
 }
 
-func logger(next http.Handler) http.Handler {
+// logger gives every request an ID, returned in the X-Request-ID header,
+// and writes an access log line once it has been served. A request ID set
+// by a proxy is kept. Requests are also counted and timed by the pattern
+// they matched in mux.
+func logger(env *Env, mux *http.ServeMux) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		next.ServeHTTP(w, r)
-		end := time.Now()
-
-		log.Printf(
-			"[%s] %s %s %s",
-			end.Format("2006-01-02 15:04:05"),
-			r.Method,
-			r.URL.Path,
-			end.Sub(start),
+		ctx, req := logging.WithRequest(r.Context(), r.Header.Get("X-Request-ID"))
+		w.Header().Set("X-Request-ID", req.ID)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		mux.ServeHTTP(rec, r.WithContext(ctx))
+		latency := time.Since(start)
+
+		env.Logger.LogAttrs(ctx, slog.LevelInfo, "Served request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.String("user", req.User),
+			slog.Duration("latency", latency),
 		)
+
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		metrics.HTTPRequests.WithLabelValues(r.Method, route, strconv.Itoa(rec.status)).Inc()
+		metrics.HTTPDuration.WithLabelValues(r.Method, route).Observe(latency.Seconds())
 	})
 }
 
+// statusRecorder notes the status code and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, which
+// streaming responses need to flush.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 func Export(env *Env) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		env.InfoLog.Println("Serving export")
+		env.Logger.DebugContext(r.Context(), "Serving export")
 		exportType := r.PathValue("type")
 		id := r.PathValue("id")
 
-		// Redirect to the export page
-		w.Header().Add("HX-Redirect", fmt.Sprintf("/export/%s/%s", exportType, id))
+		// Redirect to the export page, keeping options such as ?template=
+		location := basepath.URL(r.Context(), fmt.Sprintf("/export/%s/%s", exportType, id))
+		if r.URL.RawQuery != "" {
+			location += "?" + r.URL.RawQuery
+		}
+		w.Header().Add("HX-Redirect", location)
 		w.WriteHeader(http.StatusSeeOther)
 	})
 }
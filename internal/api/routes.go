@@ -1,144 +1,176 @@
 package api
 
 import (
-	"encoding/json"
+	"database/sql"
 	"fmt"
-	"io"
 	"net/http"
+	"slices"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/a-h/templ"
 
 	ui "github.com/parthshahp/booknotes/components"
+	"github.com/parthshahp/booknotes/internal/basepath"
 	"github.com/parthshahp/booknotes/internal/db"
+	"github.com/parthshahp/booknotes/internal/jobs"
 	. "github.com/parthshahp/booknotes/internal/types"
 )
 
 func Index(env *Env, db *db.DB) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		env.InfoLog.Println("Serving index")
+		env.Logger.DebugContext(r.Context(), "Serving index")
 		// templ.Handler(ui.Page()).ServeHTTP(w, r)
-		books := GetAllBooks(db, env, "")
-		templ.Handler(ui.Page(books)).ServeHTTP(w, r)
+		page, ok := loadBookPage(w, r, env, db)
+		if !ok {
+			return
+		}
+		templ.Handler(ui.Page(CurrentUser(r), CSRFToken(r), page)).ServeHTTP(w, r)
 	})
 }
 
+// Table swaps the book table into the page, keeping the address bar in
+// step so the view can be bookmarked.
 func Table(env *Env, db *db.DB) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		books := GetAllBooks(db, env, "")
-		env.InfoLog.Println("Serving table")
-		templ.Handler(ui.BookTable(books)).ServeHTTP(w, r)
+		env.Logger.DebugContext(r.Context(), "Serving table")
+		page, ok := loadBookPage(w, r, env, db)
+		if !ok {
+			return
+		}
+		w.Header().Set("HX-Push-Url", bookTableURL(r, page.Query))
+		templ.Handler(ui.BookTable(page)).ServeHTTP(w, r)
 	})
 }
 
-func ImportPage(env *Env) http.HandlerFunc {
+func ImportPage(env *Env, db *db.DB, queue *jobs.Queue) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		env.InfoLog.Println("Serving import")
-		templ.Handler(ui.Import()).ServeHTTP(w, r)
+		env.Logger.DebugContext(r.Context(), "Serving import")
+		user := CurrentUser(r)
+		active, err := GetActiveImportJobs(db, queue, user.ID)
+		if err != nil {
+			http.Error(w, "Unable to load imports", http.StatusInternalServerError)
+			env.Logger.ErrorContext(r.Context(), "Error loading import jobs", "err", err)
+			return
+		}
+		templ.Handler(ui.Import(user, active)).ServeHTTP(w, r)
 	})
 }
 
-func ImportFile(env *Env, db *db.DB) http.HandlerFunc {
+// ImportFile queues the uploaded files for import and answers at once with
+// the job's progress, which the page polls until the job finishes.
+func ImportFile(env *Env, db *db.DB, queue *jobs.Queue) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		env.InfoLog.Println("Serving import")
+		env.Logger.DebugContext(r.Context(), "Serving import")
 
-		// Parse the multipart form
-		err := r.ParseMultipartForm(32 << 20)
+		r.Body = http.MaxBytesReader(w, r.Body, env.Import.MaxUploadBytes())
+		uploads, err := readUploads(r)
 		if err != nil {
-			http.Error(w, "Unable to parse multipart form", http.StatusBadRequest)
-			env.ErrorLog.Println("Error parsing multipart form:", err)
+			http.Error(w, "Unable to read upload", http.StatusBadRequest)
+			env.Logger.ErrorContext(r.Context(), "Error reading upload", "err", err)
 			return
 		}
-
-		files := r.MultipartForm.File["file"]
-		if len(files) == 0 {
+		if len(uploads) == 0 {
 			http.Error(w, "No files uploaded", http.StatusBadRequest)
-			env.ErrorLog.Println("No files found in the request")
+			env.Logger.ErrorContext(r.Context(), "No files found in the request")
 			return
 		}
 
-		for _, f := range files {
-			file, err := f.Open()
-			if err != nil {
-				http.Error(w, "Unable to open file", http.StatusInternalServerError)
-				env.ErrorLog.Println("Error opening file:", err)
-				return
-			}
-			defer file.Close()
-
-			var book BookImport
-
-			data, err := io.ReadAll(file)
-			if err != nil {
-				env.ErrorLog.Fatalf("Failed to read file: %s", err)
-			}
-
-			err = json.Unmarshal(data, &book)
-			if err != nil {
-				env.ErrorLog.Fatalf("Failed to unmarshal JSON: %s", err)
-			}
-
-			InsertData(book, db, env)
+		user := CurrentUser(r)
+		jobID, err := enqueueImport(db, queue, user.ID, uploads)
+		if err != nil {
+			http.Error(w, "Unable to queue import", http.StatusInternalServerError)
+			env.Logger.ErrorContext(r.Context(), "Error queueing import", "err", err)
+			return
+		}
+		job, err := GetImportJob(db, queue, user.ID, jobID)
+		if err != nil {
+			http.Error(w, "Unable to load import", http.StatusInternalServerError)
+			env.Logger.ErrorContext(r.Context(), "Error loading import job", "err", err)
+			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("File uploaded successfully"))
+		w.Header().Set("Location", basepath.URL(r.Context(), fmt.Sprintf("/import/jobs/%d", jobID)))
+		w.WriteHeader(http.StatusAccepted)
+		ui.ImportJobProgress(job).Render(r.Context(), w)
 	}
 }
 
 func GetHighlights(env *Env, db *db.DB) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		bookID := r.PathValue("id")
-		env.InfoLog.Println("Serving highlights for book", bookID)
+		env.Logger.DebugContext(r.Context(), "Serving highlights", "book", bookID)
 		if bookID == "" {
 			http.Error(w, "No book ID provided", http.StatusBadRequest)
-			env.ErrorLog.Println("No book ID provided")
+			env.Logger.ErrorContext(r.Context(), "No book ID provided")
+			return
+		}
+		user := CurrentUser(r)
+		book, err := GetBook(db, env, user.ID, bookID)
+		if err != nil {
+			http.Error(w, "Book not found", http.StatusNotFound)
+			return
+		}
+		entries, err := GetBookHighlights(db, env, user.ID, bookID)
+		if err != nil {
+			http.Error(w, "Unable to load highlights", http.StatusInternalServerError)
+			env.Logger.ErrorContext(r.Context(), "Error loading highlights", "err", err)
+			return
+		}
+		templates, err := GetExportTemplates(db, env, user.ID)
+		if err != nil {
+			http.Error(w, "Unable to load export templates", http.StatusInternalServerError)
 			return
 		}
-		entries := GetBookHighlights(db, env, bookID)
-		book := GetBook(db, env, bookID)
-		templ.Handler(ui.HighlightsPage(book, entries, bookID)).ServeHTTP(w, r)
+		templ.Handler(ui.HighlightsPage(book, entries, bookID, templates)).ServeHTTP(w, r)
 	})
 }
 
 func EditHighlight(env *Env, db *db.DB) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		env.InfoLog.Println("Serving edit highlight")
+		env.Logger.DebugContext(r.Context(), "Serving edit highlight")
 		pathID := r.PathValue("id")
 		// Create Entry
 		if pathID == "" {
 			http.Error(w, "No highlight ID provided", http.StatusBadRequest)
-			env.ErrorLog.Println("No highlight ID provided")
+			env.Logger.ErrorContext(r.Context(), "No highlight ID provided")
 			return
 		}
 		// Convert highlightID to int from string
 		highlightID, err := strconv.Atoi(pathID)
 		if err != nil {
 			http.Error(w, "Invalid highlight ID provided", http.StatusBadRequest)
-			env.ErrorLog.Println("Invalid highlight ID provided")
+			env.Logger.ErrorContext(r.Context(), "Invalid highlight ID provided")
 			return
 		}
 
 		// Parse the form
 		if err := r.ParseForm(); err != nil {
 			http.Error(w, "Unable to parse form", http.StatusBadRequest)
-			env.ErrorLog.Println("Error parsing form:", err)
+			env.Logger.ErrorContext(r.Context(), "Error parsing form", "err", err)
 			return
 		}
 		updatedEntry := Entry{ID: highlightID}
 		updatedEntry.Page, err = strconv.Atoi(r.FormValue("page"))
 		if err != nil {
 			http.Error(w, "Invalid page number provided", http.StatusBadRequest)
-			env.ErrorLog.Println("Invalid page number provided")
+			env.Logger.ErrorContext(r.Context(), "Invalid page number provided")
 			return
 		}
 		updatedEntry.Chapter = r.FormValue("chapter")
 		updatedEntry.Text = r.FormValue("text")
 		updatedEntry.Note = r.FormValue("note")
 
-		updatedEntry = UpdateHighlight(db, env, updatedEntry)
+		updatedEntry, err = UpdateHighlight(db, env, CurrentUser(r).ID, updatedEntry)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Highlight not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Unable to update highlight", http.StatusInternalServerError)
+			env.Logger.ErrorContext(r.Context(), "Error updating highlight", "err", err)
+			return
+		}
 
 		templ.Handler(ui.Highlight(fmt.Sprintf("%d", updatedEntry.ID), updatedEntry.Chapter, updatedEntry.Text, updatedEntry.Note, fmt.Sprintf("%d", updatedEntry.Page), time.Unix(updatedEntry.Time, 0).Format("2006-01-02"))).
 			ServeHTTP(w, r)
@@ -147,122 +179,270 @@ func EditHighlight(env *Env, db *db.DB) http.HandlerFunc {
 
 func DeleteHighlight(env *Env, db *db.DB) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		env.InfoLog.Println("Serving delete highlight")
+		env.Logger.DebugContext(r.Context(), "Serving delete highlight")
 		pathID := r.PathValue("id")
 		if pathID == "" {
 			http.Error(w, "No highlight ID provided", http.StatusBadRequest)
-			env.ErrorLog.Println("No highlight ID provided")
+			env.Logger.ErrorContext(r.Context(), "No highlight ID provided")
 			return
 		}
 
-		query := `DELETE FROM entries WHERE id = ?;`
-		stmt, err := db.Prepare(query)
-		if err != nil {
-			env.ErrorLog.Fatalf("Failed to prepare query: %s", err)
-		}
-		defer stmt.Close()
-
-		if _, err := stmt.Exec(pathID); err != nil {
-			env.ErrorLog.Fatalf("Failed to delete highlight: %s", err)
+		query := `DELETE FROM entries WHERE id = ? AND user_id = ?;`
+		if _, err := db.Exec(query, pathID, CurrentUser(r).ID); err != nil {
+			http.Error(w, "Unable to delete highlight", http.StatusInternalServerError)
+			env.Logger.ErrorContext(r.Context(), "Error deleting highlight", "err", err)
+			return
 		}
 	})
 }
 
 func EditBook(env *Env, db *db.DB) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		env.InfoLog.Println("Serving edit book")
+		env.Logger.DebugContext(r.Context(), "Serving edit book")
 		pathID := r.PathValue("id")
 		if pathID == "" {
 			http.Error(w, "No book ID provided", http.StatusBadRequest)
-			env.ErrorLog.Println("No book ID provided")
+			env.Logger.ErrorContext(r.Context(), "No book ID provided")
 			return
 		}
 
 		if err := r.ParseForm(); err != nil {
 			http.Error(w, "Unable to parse form", http.StatusBadRequest)
-			env.ErrorLog.Println("Error parsing form:", err)
+			env.Logger.ErrorContext(r.Context(), "Error parsing form", "err", err)
 			return
 		}
 
-		var authors []string
-		// Split authors by comma
-		for _, author := range strings.Split(r.FormValue("author"), ",") {
-			authors = append(authors, strings.TrimSpace(author))
+		user := CurrentUser(r)
+		err := UpdateBook(db, env, user.ID, r.FormValue("title"), pathID, splitNames(r.FormValue("author")))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Book not found", http.StatusNotFound)
+			return
 		}
-
-		UpdateBook(db, env, r.FormValue("title"), pathID, authors)
-		book := GetBook(db, env, pathID)
-		templ.Handler(
-			ui.BookTableEntry(
-				book.Title,
-				strings.Join(book.Authors, ", "),
-				book.TimeCreatedOn.Format("2006-01-02"),
-				strconv.Itoa(book.EntryCount),
-				fmt.Sprintf("%d", book.ID),
-			),
-		).
+		if err != nil {
+			http.Error(w, "Unable to update book", http.StatusInternalServerError)
+			env.Logger.ErrorContext(r.Context(), "Error updating book", "err", err)
+			return
+		}
+		// The form names its tags and collections fields after the tables
+		for _, labels := range []bookLabels{tagLabels, collectionLabels} {
+			if err := labels.set(db, user.ID, pathID, splitNames(r.FormValue(labels.table))); err != nil {
+				http.Error(w, "Unable to update book", http.StatusInternalServerError)
+				env.Logger.ErrorContext(r.Context(), "Error updating book "+labels.table, "err", err)
+				return
+			}
+		}
+		book, err := GetBook(db, env, user.ID, pathID)
+		if err != nil {
+			http.Error(w, "Book not found", http.StatusNotFound)
+			return
+		}
+		templ.Handler(ui.BookTableEntry(book)).
 			ServeHTTP(w, r)
 	})
 }
 
+// splitNames reads a form field of names separated by semicolons. Names
+// can hold commas, as in "Tolkien, J.R.R.", so those don't separate them.
+func splitNames(s string) []string {
+	var names []string
+	for _, name := range splitList(s, ";") {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
 func DeleteBook(env *Env, db *db.DB) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		env.InfoLog.Println("Serving delete book")
+		env.Logger.DebugContext(r.Context(), "Serving delete book")
 		pathID := r.PathValue("id")
 		if pathID == "" {
 			http.Error(w, "No book ID provided", http.StatusBadRequest)
-			env.ErrorLog.Println("No book ID provided")
+			env.Logger.ErrorContext(r.Context(), "No book ID provided")
 			return
 		}
 
-		query := `DELETE FROM books WHERE id = ?;`
-		stmt, err := db.Prepare(query)
-		if err != nil {
-			env.ErrorLog.Fatalf("Failed to prepare query: %s", err)
-		}
-		defer stmt.Close()
-
-		if _, err := stmt.Exec(pathID); err != nil {
-			env.ErrorLog.Fatalf("Failed to delete book: %s", err)
+		err := RemoveBook(db, env, CurrentUser(r).ID, pathID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Book not found", http.StatusNotFound)
+			return
 		}
-
-		query = `DELETE FROM book_authors WHERE book_id = ?;`
-		stmt, err = db.Prepare(query)
 		if err != nil {
-			env.ErrorLog.Fatalf("Failed to prepare query: %s", err)
-		}
-		defer stmt.Close()
-
-		if _, err := stmt.Exec(pathID); err != nil {
-			env.ErrorLog.Fatalf("Failed to delete authors: %s", err)
+			http.Error(w, "Unable to delete book", http.StatusInternalServerError)
+			env.Logger.ErrorContext(r.Context(), "Error deleting book", "err", err)
+			return
 		}
 	})
 }
 
+// SearchBookTable answers the table's search, filter, sort and page
+// controls with the matching rows, leaving the controls in place.
 func SearchBookTable(env *Env, db *db.DB) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		env.InfoLog.Println("Serving search book table")
-		query := r.FormValue("search")
-		env.InfoLog.Println("Search query:", query)
-		books := GetAllBooks(db, env, query)
-		templ.Handler(ui.BookTableTable(books)).ServeHTTP(w, r)
+		env.Logger.DebugContext(r.Context(), "Serving search book table")
+		page, ok := loadBookPage(w, r, env, db)
+		if !ok {
+			return
+		}
+		w.Header().Set("HX-Push-Url", bookTableURL(r, page.Query))
+		templ.Handler(ui.BookTableTable(page)).ServeHTTP(w, r)
 	})
 }
 
 func SearchHighlightsPage(env *Env, db *db.DB) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		env.InfoLog.Println("Serving highlights")
+		env.Logger.DebugContext(r.Context(), "Serving highlights")
 		templ.Handler(ui.HighlightsSearch()).ServeHTTP(w, r)
 	})
 }
 
 func SearchHighlights(env *Env, db *db.DB) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		env.InfoLog.Println("Serving search highlights")
+		env.Logger.DebugContext(r.Context(), "Serving search highlights")
 		query := r.FormValue("search")
-		env.InfoLog.Println("Search query:", query)
-		highlights := SearchAllHighlights(db, env, query)
-		env.InfoLog.Println("Found", len(highlights), "highlights")
+		highlights, err := SearchAllHighlights(db, env, CurrentUser(r).ID, query)
+		if err != nil {
+			http.Error(w, "Unable to search highlights", http.StatusInternalServerError)
+			env.Logger.ErrorContext(r.Context(), "Error searching highlights", "err", err)
+			return
+		}
+		env.Logger.DebugContext(r.Context(), "Searched highlights", "found", len(highlights))
 		templ.Handler(ui.HighlightResults(highlights)).ServeHTTP(w, r)
 	})
 }
+
+func TemplatesPage(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving export templates")
+		user := CurrentUser(r)
+		templates, err := GetExportTemplates(db, env, user.ID)
+		if err != nil {
+			http.Error(w, "Unable to load export templates", http.StatusInternalServerError)
+			return
+		}
+		books, err := GetAllBooks(db, env, user.ID, "")
+		if err != nil {
+			http.Error(w, "Unable to load books", http.StatusInternalServerError)
+			env.Logger.ErrorContext(r.Context(), "Error loading books", "err", err)
+			return
+		}
+		current := ExportTemplate{Body: DefaultExportTemplate}
+		templ.Handler(ui.TemplatesPage(templates, current, books, "")).ServeHTTP(w, r)
+	})
+}
+
+func EditTemplate(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving edit export template")
+		user := CurrentUser(r)
+		current, err := GetExportTemplateByID(db, env, user.ID, r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Unknown export template", http.StatusNotFound)
+			return
+		}
+		books, err := GetAllBooks(db, env, user.ID, "")
+		if err != nil {
+			http.Error(w, "Unable to load books", http.StatusInternalServerError)
+			env.Logger.ErrorContext(r.Context(), "Error loading books", "err", err)
+			return
+		}
+		templ.Handler(ui.TemplateEditor(current, books, "")).ServeHTTP(w, r)
+	})
+}
+
+func SaveTemplate(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving save export template")
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Unable to parse form", http.StatusBadRequest)
+			env.Logger.ErrorContext(r.Context(), "Error parsing form", "err", err)
+			return
+		}
+
+		current := ExportTemplate{
+			Name: r.FormValue("name"),
+			Body: r.FormValue("body"),
+		}
+		if id := r.FormValue("id"); id != "" {
+			templateID, err := strconv.Atoi(id)
+			if err != nil {
+				http.Error(w, "Invalid template ID provided", http.StatusBadRequest)
+				env.Logger.ErrorContext(r.Context(), "Invalid template ID provided")
+				return
+			}
+			current.ID = templateID
+		}
+
+		// Show validation errors next to the editor instead of dropping the edit
+		errMsg := ""
+		user := CurrentUser(r)
+		saved, err := SaveExportTemplate(db, env, user.ID, current)
+		if err == ErrTemplateNotFound {
+			http.Error(w, "Unknown export template", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			errMsg = err.Error()
+		} else {
+			current = saved
+		}
+
+		templates, err := GetExportTemplates(db, env, user.ID)
+		if err != nil {
+			http.Error(w, "Unable to load export templates", http.StatusInternalServerError)
+			return
+		}
+		books, err := GetAllBooks(db, env, user.ID, "")
+		if err != nil {
+			http.Error(w, "Unable to load books", http.StatusInternalServerError)
+			env.Logger.ErrorContext(r.Context(), "Error loading books", "err", err)
+			return
+		}
+		templ.Handler(ui.TemplatesPage(templates, current, books, errMsg)).ServeHTTP(w, r)
+	})
+}
+
+func DeleteTemplate(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving delete export template")
+		if err := DeleteExportTemplate(db, env, CurrentUser(r).ID, r.PathValue("id")); err != nil {
+			http.Error(w, "Unable to delete export template", http.StatusInternalServerError)
+			return
+		}
+	})
+}
+
+func PreviewTemplate(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bookID := r.FormValue("book")
+		if bookID == "" {
+			templ.Handler(ui.TemplatePreview("", "Select a book to preview the export")).ServeHTTP(w, r)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Unable to parse form", http.StatusBadRequest)
+			env.Logger.ErrorContext(r.Context(), "Error parsing form", "err", err)
+			return
+		}
+		opts, err := ParseExportOptions(r.Form)
+		if err != nil {
+			templ.Handler(ui.TemplatePreview("", err.Error())).ServeHTTP(w, r)
+			return
+		}
+
+		data, err := GetExportBook(db, env, CurrentUser(r).ID, bookID, opts)
+		if err != nil {
+			templ.Handler(ui.TemplatePreview("", "Unable to load book")).ServeHTTP(w, r)
+			return
+		}
+
+		result, err := RenderExportTemplate("preview", r.FormValue("body"), data)
+		if err != nil {
+			templ.Handler(ui.TemplatePreview("", err.Error())).ServeHTTP(w, r)
+			return
+		}
+		templ.Handler(ui.TemplatePreview(result, "")).ServeHTTP(w, r)
+	})
+}
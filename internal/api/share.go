@@ -0,0 +1,222 @@
+package api
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/a-h/templ"
+
+	ui "github.com/parthshahp/booknotes/components"
+	"github.com/parthshahp/booknotes/internal/basepath"
+	"github.com/parthshahp/booknotes/internal/db"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+// CreateShareLink makes a new link to the book's highlights. Unlike API
+// tokens the link token is stored as is so the owner can copy it again
+// from the share page. An expiresIn of 0 never expires.
+func CreateShareLink(db *db.DB, env *Env, userID int, bookID string, hideNotes bool, expiresIn time.Duration) (ShareLink, error) {
+	book, err := GetBook(db, env, userID, bookID)
+	if err != nil {
+		return ShareLink{}, err
+	}
+
+	token, err := randomToken(24)
+	if err != nil {
+		return ShareLink{}, err
+	}
+
+	link := ShareLink{
+		Token:     token,
+		BookID:    book.ID,
+		BookTitle: book.Title,
+		HideNotes: hideNotes,
+		CreatedOn: time.Now(),
+	}
+	var expiresOn any
+	if expiresIn > 0 {
+		link.ExpiresOn = link.CreatedOn.Add(expiresIn)
+		expiresOn = link.ExpiresOn.Unix()
+	}
+
+	res, err := db.Exec(
+		`INSERT INTO share_links (user_id, book_id, token, hide_notes, created_on, expires_on) VALUES (?, ?, ?, ?, ?, ?);`,
+		userID, book.ID, token, hideNotes, link.CreatedOn.Unix(), expiresOn,
+	)
+	if err != nil {
+		env.Logger.Error("Failed to insert share link", "err", err)
+		return ShareLink{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return ShareLink{}, err
+	}
+	link.ID = int(id)
+	return link, nil
+}
+
+// GetShareLinks returns the user's links that haven't expired.
+func GetShareLinks(db *db.DB, env *Env, userID int) ([]ShareLink, error) {
+	rows, err := db.Query(`
+    SELECT s.id, s.token, s.book_id, COALESCE(b.title, ''), s.hide_notes, s.created_on, COALESCE(s.expires_on, 0)
+    FROM share_links s
+    JOIN books b ON s.book_id = b.id
+    WHERE s.user_id = ? AND (s.expires_on IS NULL OR s.expires_on > ?)
+    ORDER BY s.created_on DESC;
+  `, userID, time.Now().Unix())
+	if err != nil {
+		env.Logger.Error("Failed to query share links", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []ShareLink
+	for rows.Next() {
+		var link ShareLink
+		var createdOn, expiresOn int64
+		if err := rows.Scan(&link.ID, &link.Token, &link.BookID, &link.BookTitle, &link.HideNotes, &createdOn, &expiresOn); err != nil {
+			env.Logger.Error("Failed to scan share link", "err", err)
+			return nil, err
+		}
+		link.CreatedOn = time.Unix(createdOn, 0)
+		if expiresOn != 0 {
+			link.ExpiresOn = time.Unix(expiresOn, 0)
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+func RevokeShareLink(db *db.DB, env *Env, userID int, id string) error {
+	_, err := db.Exec(`DELETE FROM share_links WHERE id = ? AND user_id = ?;`, id, userID)
+	if err != nil {
+		env.Logger.Error("Failed to revoke share link", "err", err)
+	}
+	return err
+}
+
+// GetShareLink looks up an active link and the user who shared it.
+func GetShareLink(db *db.DB, token string) (ShareLink, int, error) {
+	var link ShareLink
+	var userID int
+	err := db.QueryRow(`
+    SELECT id, user_id, book_id, hide_notes
+    FROM share_links
+    WHERE token = ? AND (expires_on IS NULL OR expires_on > ?);
+  `, token, time.Now().Unix()).Scan(&link.ID, &userID, &link.BookID, &link.HideNotes)
+	link.Token = token
+	return link, userID, err
+}
+
+// AbsoluteURL builds a link to path, under the base path, from the request
+// so it matches the address the user is browsing from.
+func AbsoluteURL(r *http.Request, path string) string {
+	scheme := "http"
+	if isHTTPS(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + basepath.URL(r.Context(), path)
+}
+
+// ShareURL is the absolute link to hand out for a share token.
+func ShareURL(r *http.Request, token string) string {
+	return AbsoluteURL(r, "/s/"+token)
+}
+
+func ShareBook(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving share book")
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Unable to parse form", http.StatusBadRequest)
+			env.Logger.ErrorContext(r.Context(), "Error parsing form", "err", err)
+			return
+		}
+
+		var expiresIn time.Duration
+		if v := r.FormValue("expires"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				http.Error(w, "Invalid expiry", http.StatusBadRequest)
+				return
+			}
+			expiresIn = d
+		}
+		hideNotes, _ := strconv.ParseBool(r.FormValue("hide_notes"))
+
+		link, err := CreateShareLink(db, env, CurrentUser(r).ID, r.PathValue("id"), hideNotes, expiresIn)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Book not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Unable to create share link", http.StatusInternalServerError)
+			return
+		}
+		templ.Handler(ui.ShareCreated(ShareURL(r, link.Token), link)).ServeHTTP(w, r)
+	})
+}
+
+func SharesPage(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving share links")
+		links, err := GetShareLinks(db, env, CurrentUser(r).ID)
+		if err != nil {
+			http.Error(w, "Unable to load share links", http.StatusInternalServerError)
+			return
+		}
+		urls := make([]string, len(links))
+		for i, link := range links {
+			urls[i] = ShareURL(r, link.Token)
+		}
+		templ.Handler(ui.SharesPage(links, urls)).ServeHTTP(w, r)
+	})
+}
+
+func RevokeShare(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving revoke share link")
+		if err := RevokeShareLink(db, env, CurrentUser(r).ID, r.PathValue("id")); err != nil {
+			http.Error(w, "Unable to revoke share link", http.StatusInternalServerError)
+			return
+		}
+	})
+}
+
+// SharedHighlights renders the public, read-only page behind a share link.
+func SharedHighlights(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving shared highlights")
+		link, userID, err := GetShareLink(db, r.PathValue("token"))
+		if err != nil {
+			if err != sql.ErrNoRows {
+				env.Logger.ErrorContext(r.Context(), "Error loading share link", "err", err)
+			}
+			http.Error(w, "This link has expired or been revoked", http.StatusNotFound)
+			return
+		}
+
+		bookID := strconv.Itoa(link.BookID)
+		book, err := GetBook(db, env, userID, bookID)
+		if err != nil {
+			http.Error(w, "This link has expired or been revoked", http.StatusNotFound)
+			return
+		}
+		entries, err := GetBookHighlights(db, env, userID, bookID)
+		if err != nil {
+			http.Error(w, "Unable to load highlights", http.StatusInternalServerError)
+			env.Logger.ErrorContext(r.Context(), "Error loading highlights", "err", err)
+			return
+		}
+		if link.HideNotes {
+			for i := range entries {
+				entries[i].Note = ""
+			}
+		}
+
+		w.Header().Set("X-Robots-Tag", "noindex")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		templ.Handler(ui.SharedHighlightsPage(book, entries)).ServeHTTP(w, r)
+	})
+}
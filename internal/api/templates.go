@@ -0,0 +1,216 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/parthshahp/booknotes/internal/db"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+// Helper functions available inside export templates, e.g.
+// {{ .Book.TimeCreatedOn | date "2006-01-02" }} or {{ .Text | wrap 80 }}.
+var templateFuncs = template.FuncMap{
+	"date":       formatDate,
+	"wrap":       wrapText,
+	"slugify":    slugify,
+	"blockquote": blockquote,
+	"join":       strings.Join,
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"trim":       strings.TrimSpace,
+}
+
+// formatDate formats a time.Time or a unix timestamp with a Go layout.
+func formatDate(layout string, value any) string {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Format(layout)
+	case int64:
+		return time.Unix(v, 0).Format(layout)
+	case int:
+		return time.Unix(int64(v), 0).Format(layout)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// wrapText hard wraps text at word boundaries so no line exceeds width
+// characters.
+func wrapText(width int, text string) string {
+	if width <= 0 {
+		return text
+	}
+
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		words := strings.Fields(paragraph)
+		if len(words) == 0 {
+			lines = append(lines, "")
+			continue
+		}
+
+		line, n := words[0], utf8.RuneCountInString(words[0])
+		for _, word := range words[1:] {
+			wordLen := utf8.RuneCountInString(word)
+			if n+1+wordLen > width {
+				lines = append(lines, line)
+				line, n = word, wordLen
+				continue
+			}
+			line += " " + word
+			n += 1 + wordLen
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+var nonSlugChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+func slugify(text string) string {
+	return strings.Trim(nonSlugChars.ReplaceAllString(strings.ToLower(text), "-"), "-")
+}
+
+// blockquote prefixes every line of text with "> ".
+func blockquote(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = "> " + line
+	}
+	return strings.Join(lines, "\n")
+}
+
+func ParseExportTemplate(name, body string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(body)
+}
+
+func RenderExportTemplate(name, body string, data ExportBook) (string, error) {
+	tmpl, err := ParseExportTemplate(name, body)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func GetExportTemplates(db *db.DB, env *Env, userID int) ([]ExportTemplate, error) {
+	query := `SELECT id, name, body, updated_on FROM export_templates WHERE user_id = ? ORDER BY name;`
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		env.Logger.Error("Failed to query export templates", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var templates []ExportTemplate
+	for rows.Next() {
+		var t ExportTemplate
+		var updatedOn int64
+		if err := rows.Scan(&t.ID, &t.Name, &t.Body, &updatedOn); err != nil {
+			env.Logger.Error("Failed to scan export template", "err", err)
+			return nil, err
+		}
+		t.UpdatedOn = time.Unix(updatedOn, 0)
+		templates = append(templates, t)
+	}
+
+	return templates, rows.Err()
+}
+
+func GetExportTemplate(db *db.DB, env *Env, userID int, name string) (ExportTemplate, error) {
+	query := `SELECT id, name, body, updated_on FROM export_templates WHERE user_id = ? AND name = ?;`
+	return getExportTemplate(db, env, query, userID, name)
+}
+
+func GetExportTemplateByID(db *db.DB, env *Env, userID int, id string) (ExportTemplate, error) {
+	query := `SELECT id, name, body, updated_on FROM export_templates WHERE user_id = ? AND id = ?;`
+	return getExportTemplate(db, env, query, userID, id)
+}
+
+func getExportTemplate(db *db.DB, env *Env, query string, userID int, arg string) (ExportTemplate, error) {
+	var t ExportTemplate
+	var updatedOn int64
+	if err := db.QueryRow(query, userID, arg).Scan(&t.ID, &t.Name, &t.Body, &updatedOn); err != nil {
+		env.Logger.Error("Failed to query export template", "name", arg, "err", err)
+		return t, err
+	}
+	t.UpdatedOn = time.Unix(updatedOn, 0)
+
+	return t, nil
+}
+
+// ErrTemplateNotFound is returned when saving over a template the user
+// doesn't have.
+var ErrTemplateNotFound = errors.New("export template not found")
+
+// SaveExportTemplate validates the template body and stores it. Templates
+// with an ID are updated in place, otherwise they are inserted or replace
+// the template with the same name.
+func SaveExportTemplate(db *db.DB, env *Env, userID int, t ExportTemplate) (ExportTemplate, error) {
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" {
+		return t, fmt.Errorf("template name is required")
+	}
+	if _, err := ParseExportTemplate(t.Name, t.Body); err != nil {
+		return t, err
+	}
+
+	now := time.Now()
+	if t.ID != 0 {
+		query := `UPDATE export_templates SET name = ?, body = ?, updated_on = ? WHERE id = ? AND user_id = ?;`
+		res, err := db.Exec(query, t.Name, t.Body, now.Unix(), t.ID, userID)
+		if err != nil {
+			env.Logger.Error("Failed to update export template", "err", err)
+			return t, err
+		}
+		// The template is missing or belongs to someone else
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return t, ErrTemplateNotFound
+		}
+	} else {
+		query := `
+      INSERT INTO export_templates (user_id, name, body, updated_on) VALUES (?, ?, ?, ?)
+      ON CONFLICT (user_id, name) DO UPDATE SET body = excluded.body, updated_on = excluded.updated_on;
+    `
+		if _, err := db.Exec(query, userID, t.Name, t.Body, now.Unix()); err != nil {
+			env.Logger.Error("Failed to insert export template", "err", err)
+			return t, err
+		}
+	}
+
+	return GetExportTemplate(db, env, userID, t.Name)
+}
+
+func DeleteExportTemplate(db *db.DB, env *Env, userID int, id string) error {
+	query := `DELETE FROM export_templates WHERE id = ? AND user_id = ?;`
+	if _, err := db.Exec(query, id, userID); err != nil {
+		env.Logger.Error("Failed to delete export template", "err", err)
+		return err
+	}
+	return nil
+}
+
+// DefaultExportTemplate is the starting point offered when creating a new
+// template. It mirrors the built-in Markdown export.
+const DefaultExportTemplate = `# Title: {{ .Book.Title }}
+*Authors: {{ join .Authors ", " }}*
+*Date: {{ .Book.TimeCreatedOn | date "2006-01-02" }}*
+{{ range .Groups }}{{ if .Title }}
+## {{ .Title }}
+{{ end }}{{ range .Entries }}
+{{ blockquote .Text }}
+*Page {{ .Page }}*
+{{ if .Note }}{{ .Note }}
+{{ end }}{{ end }}{{ end }}`
@@ -0,0 +1,237 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/a-h/templ"
+
+	ui "github.com/parthshahp/booknotes/components"
+	"github.com/parthshahp/booknotes/internal/db"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+// tokenPrefix makes tokens easy to recognise in scripts and secret scanners
+const tokenPrefix = "bn_"
+
+func GetApiTokens(db *db.DB, env *Env, userID int) ([]ApiToken, error) {
+	rows, err := db.Query(`
+    SELECT id, name, scopes, created_on, COALESCE(last_used_on, 0)
+    FROM api_tokens
+    WHERE user_id = ?
+    ORDER BY created_on DESC;
+  `, userID)
+	if err != nil {
+		env.Logger.Error("Failed to query api tokens", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []ApiToken
+	for rows.Next() {
+		token, err := scanApiToken(rows)
+		if err != nil {
+			env.Logger.Error("Failed to scan api token", "err", err)
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func scanApiToken(row interface{ Scan(...any) error }) (ApiToken, error) {
+	var token ApiToken
+	var scopes string
+	var createdOn, lastUsedOn int64
+	if err := row.Scan(&token.ID, &token.Name, &scopes, &createdOn, &lastUsedOn); err != nil {
+		return ApiToken{}, err
+	}
+	token.Scopes = strings.Split(scopes, ",")
+	token.CreatedOn = time.Unix(createdOn, 0)
+	if lastUsedOn != 0 {
+		token.LastUsedOn = time.Unix(lastUsedOn, 0)
+	}
+	return token, nil
+}
+
+// CreateApiToken stores a new token for the user and returns the secret,
+// which is only ever shown once. Only admins can create admin tokens.
+func CreateApiToken(db *db.DB, env *Env, user User, name string, scopes []string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("name is required")
+	}
+	if len(scopes) == 0 {
+		return "", errors.New("select at least one scope")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(Scopes, scope) {
+			return "", errors.New("unknown scope " + scope)
+		}
+		if scope == ScopeAdmin && user.Role != RoleAdmin {
+			return "", errors.New("only admins can create admin tokens")
+		}
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	secret = tokenPrefix + secret
+
+	_, err = db.Exec(
+		`INSERT INTO api_tokens (user_id, name, token_hash, scopes, created_on) VALUES (?, ?, ?, ?, ?);`,
+		user.ID, name, hashToken(secret), strings.Join(scopes, ","), time.Now().Unix(),
+	)
+	if err != nil {
+		env.Logger.Error("Failed to insert api token", "err", err)
+		return "", err
+	}
+
+	env.Logger.Info("Created api token", "name", name, "user", user.Username)
+	return secret, nil
+}
+
+func RevokeApiToken(db *db.DB, env *Env, userID int, id string) error {
+	_, err := db.Exec(`DELETE FROM api_tokens WHERE id = ? AND user_id = ?;`, id, userID)
+	if err != nil {
+		env.Logger.Error("Failed to revoke api token", "err", err)
+	}
+	return err
+}
+
+// GetTokenUser looks up the owner of a token and records that it was used.
+func GetTokenUser(db *db.DB, secret string) (User, ApiToken, error) {
+	var user User
+	var userCreatedOn int64
+	var scopes string
+	var token ApiToken
+	err := db.QueryRow(`
+    SELECT u.id, u.username, u.role, u.created_on, t.id, t.name, t.scopes
+    FROM api_tokens t
+    JOIN users u ON t.user_id = u.id
+    WHERE t.token_hash = ?;
+  `, hashToken(secret)).Scan(&user.ID, &user.Username, &user.Role, &userCreatedOn, &token.ID, &token.Name, &scopes)
+	if err != nil {
+		return User{}, ApiToken{}, err
+	}
+	user.CreatedOn = time.Unix(userCreatedOn, 0)
+	token.Scopes = strings.Split(scopes, ",")
+
+	now := time.Now()
+	token.LastUsedOn = now
+	_, err = db.Exec(`UPDATE api_tokens SET last_used_on = ? WHERE id = ?;`, now.Unix(), token.ID)
+	return user, token, err
+}
+
+// bearerToken reads the API token from the Authorization header. Besides
+// Bearer it takes the "Token" scheme Readwise clients send.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !(strings.EqualFold(scheme, "Bearer") || strings.EqualFold(scheme, "Token")) {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// RequireToken only lets requests with an "Authorization: Bearer" token
+// granting scope through and attaches the token's owner to the request.
+func RequireToken(env *Env, db *db.DB, scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			secret, ok := bearerToken(r)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="booknotes"`)
+				http.Error(w, "Missing API token", http.StatusUnauthorized)
+				return
+			}
+
+			user, token, err := GetTokenUser(db, secret)
+			if err != nil {
+				if err != sql.ErrNoRows {
+					env.Logger.ErrorContext(r.Context(), "Error loading api token", "err", err)
+				}
+				w.Header().Set("WWW-Authenticate", `Bearer realm="booknotes", error="invalid_token"`)
+				http.Error(w, "Invalid API token", http.StatusUnauthorized)
+				return
+			}
+
+			// Admin tokens stop working once their owner is no longer an admin
+			if !token.HasScope(scope) || (scope == ScopeAdmin && user.Role != RoleAdmin) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="booknotes", error="insufficient_scope", scope="`+scope+`"`)
+				http.Error(w, "API token lacks the "+scope+" scope", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), user)))
+		})
+	}
+}
+
+// RequireTokenOrSession accepts a bearer token when one is sent and the
+// session cookie otherwise, so endpoints shared by scripts and the UI keep
+// working in the browser.
+func RequireTokenOrSession(env *Env, db *db.DB, scope string, session func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	requireToken := RequireToken(env, db, scope)
+	return func(next http.Handler) http.Handler {
+		withToken := requireToken(next)
+		withSession := session(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "" {
+				withToken.ServeHTTP(w, r)
+				return
+			}
+			withSession.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TokensPage(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving api tokens")
+		renderTokens(w, r, env, db, "", "")
+	})
+}
+
+func CreateToken(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving create api token")
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Unable to parse form", http.StatusBadRequest)
+			env.Logger.ErrorContext(r.Context(), "Error parsing form", "err", err)
+			return
+		}
+
+		secret, err := CreateApiToken(db, env, CurrentUser(r), r.FormValue("name"), r.Form["scope"])
+		if err != nil {
+			renderTokens(w, r, env, db, "", err.Error())
+			return
+		}
+		renderTokens(w, r, env, db, secret, "")
+	})
+}
+
+func RevokeToken(env *Env, db *db.DB) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.Logger.DebugContext(r.Context(), "Serving revoke api token")
+		if err := RevokeApiToken(db, env, CurrentUser(r).ID, r.PathValue("id")); err != nil {
+			http.Error(w, "Unable to revoke api token", http.StatusInternalServerError)
+			return
+		}
+	})
+}
+
+func renderTokens(w http.ResponseWriter, r *http.Request, env *Env, db *db.DB, secret string, errMsg string) {
+	user := CurrentUser(r)
+	tokens, err := GetApiTokens(db, env, user.ID)
+	if err != nil {
+		http.Error(w, "Unable to load api tokens", http.StatusInternalServerError)
+		return
+	}
+	templ.Handler(ui.TokensPage(user, tokens, secret, errMsg)).ServeHTTP(w, r)
+}
@@ -0,0 +1,308 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/parthshahp/booknotes/internal/db"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+const timeLayout = "20060102T150405Z"
+
+var snapshotName = regexp.MustCompile(`^booknotes-(\d{8}T\d{6}Z)\.db$`)
+
+type Snapshot struct {
+	Name      string
+	Path      string
+	CreatedOn time.Time
+	Size      int64
+}
+
+// Run takes a snapshot every env.Backup.Interval until ctx is cancelled. A
+// snapshot is taken straight away when the newest one is already older
+// than the interval.
+func Run(ctx context.Context, db *db.DB, env *Env) {
+	cfg := env.Backup
+	if cfg.Dir == "" || cfg.Interval <= 0 {
+		return
+	}
+	env.Logger.Info("Backing up", "interval", cfg.Interval, "dir", cfg.Dir)
+
+	snapshots, err := List(cfg.Dir)
+	if err != nil {
+		env.Logger.Error("Failed to list backups", "err", err)
+	}
+	if len(snapshots) == 0 || time.Since(snapshots[0].CreatedOn) > cfg.Interval {
+		runOnce(db, env)
+	}
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			runOnce(db, env)
+		}
+	}
+}
+
+func runOnce(db *db.DB, env *Env) {
+	snapshot, err := Create(db, env)
+	if err != nil {
+		env.Logger.Error("Backup failed", "err", err)
+		return
+	}
+	env.Logger.Info("Wrote backup", "name", snapshot.Name, "bytes", snapshot.Size)
+}
+
+// Create writes a consistent snapshot of the live database with VACUUM
+// INTO, verifies it with an integrity check and prunes old snapshots.
+// Snapshots that fail the check are removed.
+func Create(db *db.DB, env *Env) (Snapshot, error) {
+	cfg := env.Backup
+	if cfg.Dir == "" {
+		return Snapshot{}, fmt.Errorf("backups are not configured")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return Snapshot{}, err
+	}
+
+	now := time.Now().UTC()
+	name := "booknotes-" + now.Format(timeLayout) + ".db"
+	path := filepath.Join(cfg.Dir, name)
+	tmp := path + ".tmp"
+
+	// VACUUM INTO refuses to overwrite, so clear any leftover partial file
+	os.Remove(tmp)
+	if _, err := db.Exec(`VACUUM INTO ?;`, tmp); err != nil {
+		return Snapshot{}, fmt.Errorf("vacuum into %s: %w", tmp, err)
+	}
+
+	if err := CheckIntegrity(tmp); err != nil {
+		os.Remove(tmp)
+		return Snapshot{}, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return Snapshot{}, err
+	}
+
+	if err := Prune(cfg.Dir, cfg.KeepDaily, cfg.KeepWeekly); err != nil {
+		env.Logger.Error("Failed to prune backups", "err", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return Snapshot{Name: name, Path: path, CreatedOn: now.Truncate(time.Second), Size: info.Size()}, nil
+}
+
+// CheckIntegrity opens the snapshot read-only and runs PRAGMA
+// integrity_check on it.
+func CheckIntegrity(path string) error {
+	snapshot, err := db.OpenDB("file:" + path + "?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer snapshot.CloseDB()
+
+	rows, err := snapshot.Query(`PRAGMA integrity_check;`)
+	if err != nil {
+		return fmt.Errorf("integrity check %s: %w", path, err)
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return err
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check %s failed: %s", path, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// List returns the snapshots in dir, newest first.
+func List(dir string) ([]Snapshot, error) {
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []Snapshot
+	for _, file := range files {
+		match := snapshotName.FindStringSubmatch(file.Name())
+		if match == nil || file.IsDir() {
+			continue
+		}
+		createdOn, err := time.Parse(timeLayout, match[1])
+		if err != nil {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		snapshots = append(snapshots, Snapshot{
+			Name:      file.Name(),
+			Path:      filepath.Join(dir, file.Name()),
+			CreatedOn: createdOn,
+			Size:      info.Size(),
+		})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedOn.After(snapshots[j].CreatedOn)
+	})
+	return snapshots, nil
+}
+
+// Find looks up a snapshot by file name. Only names produced by Create are
+// accepted so the name can safely come from a request.
+func Find(dir, name string) (Snapshot, error) {
+	if !snapshotName.MatchString(name) {
+		return Snapshot{}, os.ErrNotExist
+	}
+
+	snapshots, err := List(dir)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.Name == name {
+			return snapshot, nil
+		}
+	}
+	return Snapshot{}, os.ErrNotExist
+}
+
+// Prune keeps the newest snapshot of each of the last keepDaily days and
+// of each of the last keepWeekly ISO weeks, plus the newest snapshot
+// overall, and deletes the rest.
+func Prune(dir string, keepDaily, keepWeekly int) error {
+	if keepDaily <= 0 && keepWeekly <= 0 {
+		return nil
+	}
+
+	snapshots, err := List(dir)
+	if err != nil {
+		return err
+	}
+
+	keep := map[string]bool{}
+	days := map[string]bool{}
+	weeks := map[string]bool{}
+	for i, snapshot := range snapshots {
+		if i == 0 {
+			keep[snapshot.Name] = true
+		}
+
+		day := snapshot.CreatedOn.Format("2006-01-02")
+		if !days[day] && len(days) < keepDaily {
+			days[day] = true
+			keep[snapshot.Name] = true
+		}
+
+		year, week := snapshot.CreatedOn.ISOWeek()
+		weekKey := fmt.Sprintf("%d-%02d", year, week)
+		if !weeks[weekKey] && len(weeks) < keepWeekly {
+			weeks[weekKey] = true
+			keep[snapshot.Name] = true
+		}
+	}
+
+	for _, snapshot := range snapshots {
+		if keep[snapshot.Name] {
+			continue
+		}
+		if err := os.Remove(snapshot.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore replaces the live library with the contents of a snapshot. The
+// current database is snapshotted first so the restore can be undone.
+// Rows without an owner are given to ownerID.
+func Restore(live *db.DB, env *Env, name string, ownerID int64) error {
+	snapshot, err := Find(env.Backup.Dir, name)
+	if err != nil {
+		return err
+	}
+	if err := CheckIntegrity(snapshot.Path); err != nil {
+		return err
+	}
+
+	dump, err := readSnapshot(snapshot.Path)
+	if err != nil {
+		return fmt.Errorf("read snapshot %s: %w", name, err)
+	}
+
+	// Pruning may delete the snapshot being restored, so only take the safety
+	// snapshot once it has been read
+	if _, err := Create(live, env); err != nil {
+		return fmt.Errorf("snapshot before restore: %w", err)
+	}
+	return live.Restore(dump, true, ownerID)
+}
+
+// readSnapshot dumps the snapshot at path. Snapshots taken before a schema
+// upgrade lack the newer columns, so a temporary copy is migrated first and
+// the snapshot itself is left untouched.
+func readSnapshot(path string) (*db.Dump, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp("", "booknotes-restore-*.db")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	source, err := db.OpenDB(tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer source.CloseDB()
+
+	if err := source.Migrate(); err != nil {
+		return nil, err
+	}
+	return source.Dump()
+}
@@ -0,0 +1,98 @@
+package backup
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/parthshahp/booknotes/internal/db"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+// TestRestoreOlderSnapshot restores a snapshot taken before the OIDC, md5
+// and sync key columns were added, as backups kept across an upgrade are.
+func TestRestoreOlderSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	env := &Env{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Backup: BackupConfig{Dir: filepath.Join(dir, "backups"), KeepDaily: 7},
+	}
+
+	const name = "booknotes-20240101T000000Z.db"
+	const version = 2
+	path := filepath.Join(env.Backup.Dir, name)
+	old, err := db.OpenDB(filepath.Join(dir, "old.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.CloseDB()
+	if err := old.InitDBAt(version); err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.Exec(`
+    INSERT INTO users (id, username, password_hash, role, created_on) VALUES (1, 'reader', '', 'admin', 1700000000);
+    INSERT INTO books (id, user_id, created_on, number_of_pages, title) VALUES (1, 1, 1700000000, 320, 'Dune');
+    INSERT INTO authors (id, name) VALUES (1, 'Frank Herbert');
+    INSERT INTO book_authors (book_id, author_id) VALUES (1, 1);
+    INSERT INTO entries (book_id, user_id, time, page, chapter, text, note)
+    VALUES (1, 1, 1700000100, 12, 'Book One', 'Fear is the mind-killer.', '');
+  `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Create(old, env); err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := List(env.Backup.Dir)
+	if err != nil || len(snapshots) != 1 {
+		t.Fatalf("List = %v, %v, want one snapshot", snapshots, err)
+	}
+	// Give the snapshot a fixed name so the safety snapshot can't collide
+	if err := os.Rename(snapshots[0].Path, path); err != nil {
+		t.Fatal(err)
+	}
+
+	live, err := db.OpenDB(filepath.Join(dir, "live.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.CloseDB()
+	if err := live.InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := live.Exec(`INSERT INTO users (username, role) VALUES ('admin', 'admin');`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Restore(live, env, name, 1); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+
+	var title, author, text string
+	err = live.QueryRow(`
+    SELECT b.title, a.name, e.text
+    FROM books b
+    JOIN users u ON u.id = b.user_id AND u.username = 'reader'
+    JOIN book_authors ba ON ba.book_id = b.id
+    JOIN authors a ON a.id = ba.author_id
+    JOIN entries e ON e.book_id = b.id;
+  `).Scan(&title, &author, &text)
+	if err != nil {
+		t.Fatalf("restored book: %v", err)
+	}
+	if title != "Dune" || author != "Frank Herbert" || text != "Fear is the mind-killer." {
+		t.Errorf("restored %q by %q with %q", title, author, text)
+	}
+
+	// The snapshot itself must stay as it was taken
+	snapshot, err := db.OpenDB("file:" + path + "?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.CloseDB()
+	if got, err := snapshot.SchemaVersion(); err != nil || got != version {
+		t.Errorf("snapshot schema version = %d, %v, want %d", got, err, version)
+	}
+}
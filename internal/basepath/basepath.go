@@ -0,0 +1,47 @@
+// Package basepath tracks the path prefix booknotes is served under, so
+// links and redirects keep working behind a reverse proxy that mounts it
+// below the root, such as https://tools.example.com/booknotes/.
+package basepath
+
+import (
+	"context"
+	"path"
+	"strings"
+)
+
+type key struct{}
+
+// With records that the request ctx belongs to was made under prefix.
+func With(ctx context.Context, prefix string) context.Context {
+	return context.WithValue(ctx, key{}, prefix)
+}
+
+// FromContext returns the prefix of the request ctx belongs to, "" at the
+// root.
+func FromContext(ctx context.Context) string {
+	prefix, _ := ctx.Value(key{}).(string)
+	return prefix
+}
+
+// URL returns the root-relative path p, such as "/table", under the prefix
+// of the request ctx belongs to.
+func URL(ctx context.Context, p string) string {
+	return FromContext(ctx) + p
+}
+
+// Clean normalises a prefix to start with a slash and have none at the end,
+// so "/" and "" both mean the root. It reports false for values that
+// aren't a plain path.
+func Clean(prefix string) (string, bool) {
+	if prefix == "" {
+		return "", true
+	}
+	if !strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, "?#\\ ") {
+		return "", false
+	}
+	prefix = path.Clean(prefix)
+	if prefix == "/" {
+		return "", true
+	}
+	return prefix, true
+}
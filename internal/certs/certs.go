@@ -0,0 +1,141 @@
+// Package certs serves a TLS certificate from files that are replaced while
+// the server runs, as certbot does when it renews one.
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// pollInterval is how often the files are checked when no file system
+// event reported a change.
+const pollInterval = time.Minute
+
+// settleDelay gives a renewal time to write both files before they are read.
+const settleDelay = time.Second
+
+// Reloader holds the certificate in certFile and keyFile, loading it again
+// whenever either file changes. A broken renewal keeps the old certificate.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	logger   *slog.Logger
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	version string
+}
+
+// NewReloader loads the certificate, failing if it can't be.
+func NewReloader(certFile, keyFile string, logger *slog.Logger) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, logger: logger}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate is meant for tls.Config.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func (r *Reloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.version = r.fileVersion()
+	r.mu.Unlock()
+	return nil
+}
+
+// fileVersion changes whenever either file is replaced or written to.
+// Stat follows symlinks, so certbot's live/ links are compared by the
+// files they point to.
+func (r *Reloader) fileVersion() string {
+	var version string
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return ""
+		}
+		version += fmt.Sprintf("%d/%d;", info.ModTime().UnixNano(), info.Size())
+	}
+	return version
+}
+
+// Run reloads the certificate when its files change until ctx is
+// cancelled. Their directories are watched, since renewals usually swap
+// files or symlinks rather than writing to them, and the files are also
+// checked every minute in case events are missed.
+func (r *Reloader) Run(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		r.logger.Error("Failed to watch TLS certificate, polling instead", "err", err)
+	} else {
+		defer watcher.Close()
+		for _, dir := range []string{filepath.Dir(r.certFile), filepath.Dir(r.keyFile)} {
+			if err := watcher.Add(dir); err != nil {
+				r.logger.Error("Failed to watch TLS certificate, polling instead", "dir", dir, "err", err)
+			}
+		}
+	}
+	var events chan fsnotify.Event
+	var errs chan error
+	if watcher != nil {
+		events, errs = watcher.Events, watcher.Errors
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	settle := time.NewTimer(0)
+	settle.Stop()
+	defer settle.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-events:
+			settle.Reset(settleDelay)
+		case err := <-errs:
+			r.logger.Error("TLS certificate watch error", "err", err)
+		case <-ticker.C:
+			settle.Reset(0)
+		case <-settle.C:
+			r.reload()
+		}
+	}
+}
+
+func (r *Reloader) reload() {
+	version := r.fileVersion()
+	r.mu.RLock()
+	unchanged := version != "" && version == r.version
+	r.mu.RUnlock()
+	if unchanged {
+		return
+	}
+	if err := r.load(); err != nil {
+		r.logger.Error("Failed to reload TLS certificate, keeping the current one", "err", err)
+		// Don't try the same broken files again every minute
+		r.mu.Lock()
+		r.version = version
+		r.mu.Unlock()
+		return
+	}
+	r.logger.Info("Reloaded TLS certificate", "file", r.certFile)
+}
@@ -0,0 +1,322 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"github.com/parthshahp/booknotes/internal/basepath"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+// Config holds every setting. Load builds it from four layers, each
+// overriding the one before: the defaults, a TOML or YAML config file,
+// environment variables and command-line flags.
+type Config struct {
+	ListenAddr string `toml:"listen_addr" yaml:"listen_addr"`
+	Database   string `toml:"database" yaml:"database"`
+	// ShutdownTimeout bounds how long requests and running jobs get to
+	// finish once the server is asked to stop
+	ShutdownTimeout time.Duration `toml:"shutdown_timeout" yaml:"shutdown_timeout"`
+	HTTP            HTTPConfig    `toml:"http" yaml:"http"`
+	TLS             TLSConfig     `toml:"tls" yaml:"tls"`
+	Auth            AuthConfig    `toml:"auth" yaml:"auth"`
+	CORS            CORSConfig    `toml:"cors" yaml:"cors"`
+	Import          ImportConfig  `toml:"import" yaml:"import"`
+	Backup          BackupConfig  `toml:"backup" yaml:"backup"`
+	Watch           WatchConfig   `toml:"watch" yaml:"watch"`
+	Jobs            JobsConfig    `toml:"jobs" yaml:"jobs"`
+	Metrics         MetricsConfig `toml:"metrics" yaml:"metrics"`
+	Log             LogConfig     `toml:"log" yaml:"log"`
+}
+
+func Defaults() Config {
+	return Config{
+		ListenAddr:      ":3000",
+		Database:        "booknotes.db",
+		ShutdownTimeout: 30 * time.Second,
+		TLS:             TLSConfig{HSTSMaxAge: 365 * 24 * time.Hour},
+		Auth: AuthConfig{
+			SessionTTL: 30 * 24 * time.Hour,
+			OIDC: OIDCConfig{
+				Scopes:      []string{"openid", "profile", "email"},
+				GroupsClaim: "groups",
+				ButtonLabel: "Log in with SSO",
+			},
+		},
+		Import: ImportConfig{MaxUploadMB: 512},
+		Backup: BackupConfig{
+			Interval:   24 * time.Hour,
+			KeepDaily:  7,
+			KeepWeekly: 4,
+		},
+		Watch: WatchConfig{Interval: time.Minute},
+		Jobs:  JobsConfig{Workers: 2},
+		Log:   LogConfig{Level: LogInfo, Format: LogText},
+	}
+}
+
+// setting ties a value of Config to its environment variable and, for the
+// common ones, a command-line flag.
+type setting struct {
+	env  string
+	flag string
+	dst  any
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"LISTEN_ADDR", "addr", &c.ListenAddr},
+		{"DATABASE_LOCATION", "db", &c.Database},
+		{"SHUTDOWN_TIMEOUT", "", &c.ShutdownTimeout},
+
+		{"BASE_PATH", "base-path", &c.HTTP.BasePath},
+		{"TRUSTED_PROXIES", "", &c.HTTP.TrustedProxies},
+
+		{"TLS_CERT_FILE", "tls-cert", &c.TLS.CertFile},
+		{"TLS_KEY_FILE", "tls-key", &c.TLS.KeyFile},
+		{"TLS_REDIRECT_ADDR", "tls-redirect-addr", &c.TLS.RedirectAddr},
+		{"TLS_HSTS_MAX_AGE", "", &c.TLS.HSTSMaxAge},
+
+		{"ALLOW_SIGNUP", "allow-signup", &c.Auth.AllowSignup},
+		{"SECURE_COOKIES", "", &c.Auth.SecureCookies},
+		{"SESSION_TTL", "", &c.Auth.SessionTTL},
+		{"OIDC_ISSUER", "", &c.Auth.OIDC.Issuer},
+		{"OIDC_CLIENT_ID", "", &c.Auth.OIDC.ClientID},
+		{"OIDC_CLIENT_SECRET", "", &c.Auth.OIDC.ClientSecret},
+		{"OIDC_REDIRECT_URL", "", &c.Auth.OIDC.RedirectURL},
+		{"OIDC_SCOPES", "", &c.Auth.OIDC.Scopes},
+		{"OIDC_GROUPS_CLAIM", "", &c.Auth.OIDC.GroupsClaim},
+		{"OIDC_ADMIN_GROUPS", "", &c.Auth.OIDC.AdminGroups},
+		{"OIDC_USER_GROUPS", "", &c.Auth.OIDC.UserGroups},
+		{"OIDC_BUTTON_LABEL", "", &c.Auth.OIDC.ButtonLabel},
+
+		{"CORS_ALLOWED_ORIGINS", "", &c.CORS.AllowedOrigins},
+		{"CORS_ALLOW_CREDENTIALS", "", &c.CORS.AllowCredentials},
+
+		{"IMPORT_MAX_UPLOAD_MB", "", &c.Import.MaxUploadMB},
+
+		{"BACKUP_DIR", "backup-dir", &c.Backup.Dir},
+		{"BACKUP_INTERVAL", "", &c.Backup.Interval},
+		{"BACKUP_KEEP_DAILY", "", &c.Backup.KeepDaily},
+		{"BACKUP_KEEP_WEEKLY", "", &c.Backup.KeepWeekly},
+
+		{"WATCH_DIR", "watch-dir", &c.Watch.Dir},
+		{"WATCH_USER", "", &c.Watch.User},
+		{"WATCH_INTERVAL", "", &c.Watch.Interval},
+
+		{"JOB_WORKERS", "", &c.Jobs.Workers},
+
+		{"METRICS_ENABLED", "", &c.Metrics.Enabled},
+		{"METRICS_TOKEN", "", &c.Metrics.Token},
+
+		{"LOG_LEVEL", "log-level", &c.Log.Level},
+		{"LOG_FORMAT", "log-format", &c.Log.Format},
+	}
+}
+
+// Load reads the configuration and the global flags at the start of args,
+// returning the arguments left after them. The config file is given with
+// -config or BOOKNOTES_CONFIG.
+func Load(args []string) (Config, []string, error) {
+	cfg := Defaults()
+
+	flags := flag.NewFlagSet("booknotes", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	file := flags.String("config", os.Getenv("BOOKNOTES_CONFIG"), "")
+	// Flags are applied last, once the file and environment are read
+	var set []func() error
+	for _, s := range cfg.settings() {
+		if s.flag == "" {
+			continue
+		}
+		s := s
+		flags.Func(s.flag, "", func(v string) error {
+			set = append(set, func() error {
+				if err := parse(s.dst, v); err != nil {
+					return fmt.Errorf("invalid -%s: %w", s.flag, err)
+				}
+				return nil
+			})
+			return nil
+		})
+	}
+	if err := flags.Parse(args); err != nil {
+		return cfg, nil, err
+	}
+
+	if *file != "" {
+		if err := cfg.readFile(*file); err != nil {
+			return cfg, nil, fmt.Errorf("config file %s: %w", *file, err)
+		}
+	}
+	for _, s := range cfg.settings() {
+		if v, ok := os.LookupEnv(s.env); ok && v != "" {
+			if err := parse(s.dst, v); err != nil {
+				return cfg, nil, fmt.Errorf("invalid %s: %w", s.env, err)
+			}
+		}
+	}
+	for _, apply := range set {
+		if err := apply(); err != nil {
+			return cfg, nil, err
+		}
+	}
+
+	// "/booknotes/" and "/booknotes" mean the same
+	if base, ok := basepath.Clean(cfg.HTTP.BasePath); ok {
+		cfg.HTTP.BasePath = base
+	}
+	if err := cfg.Validate(); err != nil {
+		return cfg, nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return cfg, flags.Args(), nil
+}
+
+// readFile merges a config file into c, leaving the settings it doesn't
+// mention alone. The format follows the extension.
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		md, err := toml.Decode(string(data), c)
+		if err != nil {
+			return err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("unknown setting %s", undecoded[0])
+		}
+		return nil
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(strings.NewReader(string(data)))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && err != io.EOF {
+			return err
+		}
+		return nil
+	}
+	return errors.New("expected a .toml, .yaml or .yml file")
+}
+
+// parse sets dst from a flag or environment variable. Lists are comma
+// separated.
+func parse(dst any, v string) error {
+	switch dst := dst.(type) {
+	case *string:
+		*dst = v
+	case *bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*dst = b
+	case *int:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*dst = n
+	case *time.Duration:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*dst = d
+	case *[]string:
+		*dst = splitList(v)
+	default:
+		return fmt.Errorf("unsupported setting type %T", dst)
+	}
+	return nil
+}
+
+// Validate checks the settings together, reporting every problem at once.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.ListenAddr != "", "listen_addr must be set")
+	check(c.Database != "", "database must be set")
+	check(c.ShutdownTimeout > 0, "shutdown_timeout must be positive")
+
+	_, ok := basepath.Clean(c.HTTP.BasePath)
+	check(ok, "http.base_path must be a path such as /booknotes")
+	for _, proxy := range c.HTTP.TrustedProxies {
+		_, err := ParseTrustedProxy(proxy)
+		check(err == nil, "http.trusted_proxies: %v", err)
+	}
+
+	check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "tls.cert_file and tls.key_file must be set together")
+	check(c.TLS.RedirectAddr == "" || c.TLS.Enabled(), "tls.redirect_addr needs tls.cert_file and tls.key_file")
+	check(c.TLS.RedirectAddr == "" || c.TLS.RedirectAddr != c.ListenAddr, "tls.redirect_addr must differ from listen_addr")
+	check(c.TLS.HSTSMaxAge >= 0, "tls.hsts_max_age can't be negative")
+	for _, file := range []string{c.TLS.CertFile, c.TLS.KeyFile} {
+		if file != "" {
+			_, err := os.Stat(file)
+			check(err == nil, "tls: %v", err)
+		}
+	}
+
+	check(c.Auth.SessionTTL > 0, "auth.session_ttl must be positive")
+	oidc := c.Auth.OIDC
+	check(oidc.Issuer == "" || (oidc.ClientID != "" && oidc.RedirectURL != ""),
+		"auth.oidc.issuer needs auth.oidc.client_id and auth.oidc.redirect_url")
+
+	for _, origin := range c.CORS.AllowedOrigins {
+		check(origin != "*", "cors.allowed_origins must list origins, not *")
+	}
+
+	check(c.Import.MaxUploadMB > 0, "import.max_upload_mb must be positive")
+
+	check(c.Backup.Interval > 0, "backup.interval must be positive")
+	check(c.Backup.KeepDaily >= 0 && c.Backup.KeepWeekly >= 0, "backup.keep_daily and backup.keep_weekly can't be negative")
+
+	check(c.Watch.Interval > 0, "watch.interval must be positive")
+	check(c.Jobs.Workers > 0, "jobs.workers must be positive")
+	switch c.Log.Level {
+	case LogDebug, LogInfo, LogWarn, LogError:
+	default:
+		check(false, "log.level must be debug, info, warn or error")
+	}
+	check(c.Log.Format == LogText || c.Log.Format == LogJSON, "log.format must be text or json")
+
+	return errors.Join(errs...)
+}
+
+// Print writes the configuration as TOML, with secrets hidden.
+func (c Config) Print(w io.Writer) error {
+	if c.Auth.OIDC.ClientSecret != "" {
+		c.Auth.OIDC.ClientSecret = "********"
+	}
+	if c.Metrics.Token != "" {
+		c.Metrics.Token = "********"
+	}
+	return toml.NewEncoder(w).Encode(c)
+}
+
+// splitList splits a comma separated setting, dropping empty items.
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -2,8 +2,6 @@ package db
 
 import (
 	"database/sql"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
 type DB struct {
@@ -11,7 +9,7 @@ type DB struct {
 }
 
 func OpenDB(loc string) (*DB, error) {
-	db, err := sql.Open("sqlite3", loc)
+	db, err := sql.Open(driverName, loc)
 	if err != nil {
 		return nil, err
 	}
@@ -23,7 +21,14 @@ func (db DB) CloseDB() error {
 	return db.Close()
 }
 
+// InitDB creates the tables and brings them up to the latest schema.
 func (db DB) InitDB() error {
+	return db.InitDBAt(LatestSchemaVersion())
+}
+
+// InitDBAt creates the tables as they were once version migrations had
+// run, for tests that need a database left behind by an older release.
+func (db DB) InitDBAt(version int) error {
 	// Create tables if they don't exist
 	createTables := `
 	CREATE TABLE IF NOT EXISTS books (
@@ -58,11 +63,39 @@ func (db DB) InitDB() error {
       book_id INTEGER,
       image BLOB,
       FOREIGN KEY (book_id) REFERENCES books (id)
+  );
+  CREATE TABLE IF NOT EXISTS tags (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT UNIQUE
+  );
+  CREATE TABLE IF NOT EXISTS book_tags (
+    book_id INTEGER,
+    tag_id INTEGER,
+    FOREIGN KEY (book_id) REFERENCES books (id),
+    FOREIGN KEY (tag_id) REFERENCES tags (id),
+    PRIMARY KEY (book_id, tag_id)
+  );
+  CREATE TABLE IF NOT EXISTS collections (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT UNIQUE
+  );
+  CREATE TABLE IF NOT EXISTS collection_books (
+    collection_id INTEGER,
+    book_id INTEGER,
+    FOREIGN KEY (collection_id) REFERENCES collections (id),
+    FOREIGN KEY (book_id) REFERENCES books (id),
+    PRIMARY KEY (collection_id, book_id)
+  );
+  CREATE TABLE IF NOT EXISTS export_templates (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT UNIQUE,
+    body TEXT,
+    updated_on INTEGER
   );
 	`
 	if _, err := db.Exec(createTables); err != nil {
-		panic(err)
+		return err
 	}
 
-	return nil
+	return db.migrateTo(version)
 }
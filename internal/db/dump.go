@@ -0,0 +1,517 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// DumpVersion is bumped whenever the dump format changes. Restore accepts
+// any dump up to and including this version.
+const DumpVersion = 2
+
+// Dump is a lossless, versioned copy of every table in the database apart
+// from sessions, API tokens, share links, jobs and the import history,
+// which are recreated rather than restored. Images are []byte and therefore
+// encoded as base64 in JSON. Version 2 added users and ownership.
+type Dump struct {
+	Version         int                  `json:"version"`
+	CreatedOn       time.Time            `json:"created_on"`
+	Users           []DumpUser           `json:"users"`
+	Books           []DumpBook           `json:"books"`
+	Authors         []DumpName           `json:"authors"`
+	BookAuthors     []DumpBookAuthor     `json:"book_authors"`
+	Entries         []DumpEntry          `json:"entries"`
+	BookImages      []DumpBookImage      `json:"book_images"`
+	Tags            []DumpName           `json:"tags"`
+	BookTags        []DumpBookTag        `json:"book_tags"`
+	Collections     []DumpName           `json:"collections"`
+	CollectionBooks []DumpCollectionBook `json:"collection_books"`
+	ExportTemplates []DumpExportTemplate `json:"export_templates"`
+	Progress        []DumpProgress       `json:"progress,omitempty"`
+}
+
+// DumpUser includes the password hash so accounts survive a restore.
+type DumpUser struct {
+	ID           int64  `json:"id"`
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+	Role         string `json:"role"`
+	CreatedOn    int64  `json:"created_on"`
+	OIDCIssuer   string `json:"oidc_issuer,omitempty"`
+	OIDCSubject  string `json:"oidc_subject,omitempty"`
+	SyncKeyHash  string `json:"sync_key_hash,omitempty"`
+}
+
+type DumpBook struct {
+	ID            int64  `json:"id"`
+	UserID        int64  `json:"user_id,omitempty"`
+	CreatedOn     int64  `json:"created_on"`
+	NumberOfPages int64  `json:"number_of_pages"`
+	Title         string `json:"title"`
+	MD5           string `json:"md5,omitempty"`
+}
+
+// DumpName is a row of one of the id/name tables: authors, tags and
+// collections. Authors are shared and have no owner.
+type DumpName struct {
+	ID     int64  `json:"id"`
+	UserID int64  `json:"user_id,omitempty"`
+	Name   string `json:"name"`
+}
+
+type DumpBookAuthor struct {
+	BookID   int64 `json:"book_id"`
+	AuthorID int64 `json:"author_id"`
+}
+
+type DumpEntry struct {
+	ID      int64  `json:"id"`
+	UserID  int64  `json:"user_id,omitempty"`
+	BookID  int64  `json:"book_id"`
+	Time    int64  `json:"time"`
+	Page    int64  `json:"page"`
+	Chapter string `json:"chapter"`
+	Text    string `json:"text"`
+	Note    string `json:"note"`
+}
+
+type DumpBookImage struct {
+	ID     int64  `json:"id"`
+	BookID int64  `json:"book_id"`
+	Image  []byte `json:"image"`
+}
+
+type DumpBookTag struct {
+	BookID int64 `json:"book_id"`
+	TagID  int64 `json:"tag_id"`
+}
+
+type DumpCollectionBook struct {
+	CollectionID int64 `json:"collection_id"`
+	BookID       int64 `json:"book_id"`
+}
+
+type DumpExportTemplate struct {
+	ID        int64  `json:"id"`
+	UserID    int64  `json:"user_id,omitempty"`
+	Name      string `json:"name"`
+	Body      string `json:"body"`
+	UpdatedOn int64  `json:"updated_on"`
+}
+
+// DumpProgress is a KOReader reading position synced through kosync.
+type DumpProgress struct {
+	UserID     int64   `json:"user_id"`
+	Document   string  `json:"document"`
+	Progress   string  `json:"progress"`
+	Percentage float64 `json:"percentage"`
+	Device     string  `json:"device"`
+	DeviceID   string  `json:"device_id"`
+	Timestamp  int64   `json:"timestamp"`
+}
+
+// Dump reads every table into a Dump inside a single read transaction so
+// the copy is consistent. Rows left behind by deleted books are skipped.
+func (db DB) Dump() (*Dump, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	d := &Dump{Version: DumpVersion, CreatedOn: time.Now().UTC()}
+
+	err = queryRows(tx, `
+    SELECT id, COALESCE(username, ''), COALESCE(password_hash, ''), COALESCE(role, ''), COALESCE(created_on, 0),
+      COALESCE(oidc_issuer, ''), COALESCE(oidc_subject, ''), COALESCE(sync_key_hash, '')
+    FROM users ORDER BY id;`,
+		func(rows *sql.Rows) error {
+			var u DumpUser
+			err := rows.Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Role, &u.CreatedOn, &u.OIDCIssuer, &u.OIDCSubject, &u.SyncKeyHash)
+			d.Users = append(d.Users, u)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryRows(tx, `
+    SELECT id, COALESCE(user_id, 0), COALESCE(created_on, 0), COALESCE(number_of_pages, 0), COALESCE(title, ''), COALESCE(md5, '')
+    FROM books ORDER BY id;`,
+		func(rows *sql.Rows) error {
+			var b DumpBook
+			err := rows.Scan(&b.ID, &b.UserID, &b.CreatedOn, &b.NumberOfPages, &b.Title, &b.MD5)
+			d.Books = append(d.Books, b)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, table := range []struct {
+		name   string
+		userID string
+		dst    *[]DumpName
+	}{
+		{"authors", "0", &d.Authors},
+		{"tags", "COALESCE(user_id, 0)", &d.Tags},
+		{"collections", "COALESCE(user_id, 0)", &d.Collections},
+	} {
+		dst := table.dst
+		err = queryRows(tx, `SELECT id, `+table.userID+`, COALESCE(name, '') FROM `+table.name+` ORDER BY id;`,
+			func(rows *sql.Rows) error {
+				var n DumpName
+				err := rows.Scan(&n.ID, &n.UserID, &n.Name)
+				*dst = append(*dst, n)
+				return err
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = queryRows(tx, `SELECT book_id, author_id FROM book_authors WHERE book_id IN (SELECT id FROM books) AND author_id IN (SELECT id FROM authors);`,
+		func(rows *sql.Rows) error {
+			var ba DumpBookAuthor
+			err := rows.Scan(&ba.BookID, &ba.AuthorID)
+			d.BookAuthors = append(d.BookAuthors, ba)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryRows(tx, `
+    SELECT id, COALESCE(user_id, 0), book_id, COALESCE(time, 0), COALESCE(page, 0),
+      COALESCE(chapter, ''), COALESCE(text, ''), COALESCE(note, '')
+    FROM entries WHERE book_id IN (SELECT id FROM books) ORDER BY id;`,
+		func(rows *sql.Rows) error {
+			var e DumpEntry
+			err := rows.Scan(&e.ID, &e.UserID, &e.BookID, &e.Time, &e.Page, &e.Chapter, &e.Text, &e.Note)
+			d.Entries = append(d.Entries, e)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryRows(tx, `SELECT id, book_id, image FROM book_images WHERE book_id IN (SELECT id FROM books) ORDER BY id;`,
+		func(rows *sql.Rows) error {
+			var i DumpBookImage
+			err := rows.Scan(&i.ID, &i.BookID, &i.Image)
+			d.BookImages = append(d.BookImages, i)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryRows(tx, `SELECT book_id, tag_id FROM book_tags WHERE book_id IN (SELECT id FROM books) AND tag_id IN (SELECT id FROM tags);`,
+		func(rows *sql.Rows) error {
+			var bt DumpBookTag
+			err := rows.Scan(&bt.BookID, &bt.TagID)
+			d.BookTags = append(d.BookTags, bt)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryRows(tx, `SELECT collection_id, book_id FROM collection_books WHERE collection_id IN (SELECT id FROM collections) AND book_id IN (SELECT id FROM books);`,
+		func(rows *sql.Rows) error {
+			var cb DumpCollectionBook
+			err := rows.Scan(&cb.CollectionID, &cb.BookID)
+			d.CollectionBooks = append(d.CollectionBooks, cb)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryRows(tx, `SELECT id, COALESCE(user_id, 0), COALESCE(name, ''), COALESCE(body, ''), COALESCE(updated_on, 0) FROM export_templates ORDER BY id;`,
+		func(rows *sql.Rows) error {
+			var t DumpExportTemplate
+			err := rows.Scan(&t.ID, &t.UserID, &t.Name, &t.Body, &t.UpdatedOn)
+			d.ExportTemplates = append(d.ExportTemplates, t)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryRows(tx, `
+    SELECT user_id, document, COALESCE(progress, ''), COALESCE(percentage, 0),
+      COALESCE(device, ''), COALESCE(device_id, ''), COALESCE(timestamp, 0)
+    FROM kosync_progress WHERE user_id IN (SELECT id FROM users) ORDER BY user_id, document;`,
+		func(rows *sql.Rows) error {
+			var p DumpProgress
+			err := rows.Scan(&p.UserID, &p.Document, &p.Progress, &p.Percentage, &p.Device, &p.DeviceID, &p.Timestamp)
+			d.Progress = append(d.Progress, p)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Restore loads a dump in a single transaction. With replace the existing
+// library is wiped first and the original ids are kept. Otherwise the dump
+// is merged: rows get fresh ids, authors, tags and collections are matched
+// by name and existing export templates with the same name are kept.
+//
+// Accounts are never removed. In replace mode the dumped users are matched
+// to existing accounts by username, created when missing, and keep owning
+// their rows. In merge mode, and for rows without an owner, everything is
+// given to ownerID. An ownerID of 0 leaves rows unowned until the first
+// account is registered.
+func (db DB) Restore(d *Dump, replace bool, ownerID int64) error {
+	if d.Version < 1 || d.Version > DumpVersion {
+		return fmt.Errorf("unsupported dump version %d", d.Version)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if replace {
+		for _, table := range []string{
+			"share_links", "book_authors", "book_tags", "collection_books", "entries", "book_images",
+			"books", "authors", "tags", "collections", "export_templates",
+		} {
+			if _, err := tx.Exec(`DELETE FROM ` + table + `;`); err != nil {
+				return fmt.Errorf("clear %s: %w", table, err)
+			}
+		}
+	}
+
+	// In merge mode ids are left to SQLite and remapped
+	id := func(id int64) any {
+		if replace {
+			return id
+		}
+		return nil
+	}
+
+	userIDs := map[int64]int64{}
+	if replace {
+		if userIDs, err = restoreUsers(tx, d.Users); err != nil {
+			return err
+		}
+	}
+	owner := func(userID int64) any {
+		if mapped, ok := userIDs[userID]; ok {
+			return mapped
+		}
+		if ownerID == 0 {
+			return nil
+		}
+		return ownerID
+	}
+
+	bookIDs := map[int64]int64{}
+	for _, b := range d.Books {
+		res, err := tx.Exec(`INSERT INTO books (id, user_id, created_on, number_of_pages, title, md5) VALUES (?, ?, ?, ?, ?, NULLIF(?, ''));`,
+			id(b.ID), owner(b.UserID), b.CreatedOn, b.NumberOfPages, b.Title, b.MD5)
+		if err != nil {
+			return fmt.Errorf("restore book %d: %w", b.ID, err)
+		}
+		if bookIDs[b.ID], err = res.LastInsertId(); err != nil {
+			return err
+		}
+	}
+
+	authorIDs, err := restoreNames(tx, "authors", d.Authors, id, nil)
+	if err != nil {
+		return err
+	}
+	tagIDs, err := restoreNames(tx, "tags", d.Tags, id, owner)
+	if err != nil {
+		return err
+	}
+	collectionIDs, err := restoreNames(tx, "collections", d.Collections, id, owner)
+	if err != nil {
+		return err
+	}
+
+	for _, ba := range d.BookAuthors {
+		if err := insertLink(tx, "book_authors", "book_id", "author_id", bookIDs, ba.BookID, authorIDs, ba.AuthorID); err != nil {
+			return err
+		}
+	}
+	for _, bt := range d.BookTags {
+		if err := insertLink(tx, "book_tags", "book_id", "tag_id", bookIDs, bt.BookID, tagIDs, bt.TagID); err != nil {
+			return err
+		}
+	}
+	for _, cb := range d.CollectionBooks {
+		if err := insertLink(tx, "collection_books", "collection_id", "book_id", collectionIDs, cb.CollectionID, bookIDs, cb.BookID); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range d.Entries {
+		bookID, ok := bookIDs[e.BookID]
+		if !ok {
+			return fmt.Errorf("entry %d references unknown book %d", e.ID, e.BookID)
+		}
+		_, err := tx.Exec(`INSERT INTO entries (id, user_id, book_id, time, page, chapter, text, note) VALUES (?, ?, ?, ?, ?, ?, ?, ?);`,
+			id(e.ID), owner(e.UserID), bookID, e.Time, e.Page, e.Chapter, e.Text, e.Note)
+		if err != nil {
+			return fmt.Errorf("restore entry %d: %w", e.ID, err)
+		}
+	}
+
+	for _, i := range d.BookImages {
+		bookID, ok := bookIDs[i.BookID]
+		if !ok {
+			return fmt.Errorf("image %d references unknown book %d", i.ID, i.BookID)
+		}
+		if _, err := tx.Exec(`INSERT INTO book_images (id, book_id, image) VALUES (?, ?, ?);`, id(i.ID), bookID, i.Image); err != nil {
+			return fmt.Errorf("restore image %d: %w", i.ID, err)
+		}
+	}
+
+	for _, t := range d.ExportTemplates {
+		_, err := tx.Exec(`
+      INSERT INTO export_templates (id, user_id, name, body, updated_on) VALUES (?, ?, ?, ?, ?)
+      ON CONFLICT (user_id, name) DO NOTHING;`,
+			id(t.ID), owner(t.UserID), t.Name, t.Body, t.UpdatedOn)
+		if err != nil {
+			return fmt.Errorf("restore export template %q: %w", t.Name, err)
+		}
+	}
+
+	// Progress always belongs to an account and the newest position wins
+	for _, p := range d.Progress {
+		userID := owner(p.UserID)
+		if userID == nil {
+			continue
+		}
+		_, err := tx.Exec(`
+      INSERT INTO kosync_progress (user_id, document, progress, percentage, device, device_id, timestamp)
+      VALUES (?, ?, ?, ?, ?, ?, ?)
+      ON CONFLICT (user_id, document) DO UPDATE SET
+        progress = excluded.progress, percentage = excluded.percentage, device = excluded.device,
+        device_id = excluded.device_id, timestamp = excluded.timestamp
+      WHERE excluded.timestamp > kosync_progress.timestamp;`,
+			userID, p.Document, p.Progress, p.Percentage, p.Device, p.DeviceID, p.Timestamp)
+		if err != nil {
+			return fmt.Errorf("restore progress of %s: %w", p.Document, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// restoreUsers matches dumped users to existing accounts by username,
+// creating the missing ones, and returns the old to new id mapping.
+func restoreUsers(tx *sql.Tx, users []DumpUser) (map[int64]int64, error) {
+	ids := map[int64]int64{}
+	for _, u := range users {
+		var existing int64
+		err := tx.QueryRow(`SELECT id FROM users WHERE username = ?;`, u.Username).Scan(&existing)
+		if err == nil {
+			ids[u.ID] = existing
+			continue
+		}
+		if err != sql.ErrNoRows {
+			return nil, fmt.Errorf("restore user %q: %w", u.Username, err)
+		}
+
+		res, err := tx.Exec(`
+      INSERT INTO users (username, password_hash, role, created_on, oidc_issuer, oidc_subject, sync_key_hash)
+      VALUES (?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''));`,
+			u.Username, u.PasswordHash, u.Role, u.CreatedOn, u.OIDCIssuer, u.OIDCSubject, u.SyncKeyHash)
+		if err != nil {
+			return nil, fmt.Errorf("restore user %q: %w", u.Username, err)
+		}
+		if ids[u.ID], err = res.LastInsertId(); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// restoreNames restores an id/name table, reusing rows that already exist
+// with the same name and owner, and returns the old to new id mapping. A
+// nil owner means the table is shared between users.
+func restoreNames(
+	tx *sql.Tx,
+	table string,
+	names []DumpName,
+	id func(int64) any,
+	owner func(int64) any,
+) (map[int64]int64, error) {
+	ids := map[int64]int64{}
+	for _, n := range names {
+		lookup := `SELECT id FROM ` + table + ` WHERE name = ?;`
+		insert := `INSERT INTO ` + table + ` (id, name) VALUES (?, ?);`
+		args := []any{n.Name}
+		if owner != nil {
+			lookup = `SELECT id FROM ` + table + ` WHERE name = ? AND user_id IS ?;`
+			insert = `INSERT INTO ` + table + ` (id, name, user_id) VALUES (?, ?, ?);`
+			args = append(args, owner(n.UserID))
+		}
+
+		var existing int64
+		err := tx.QueryRow(lookup, args...).Scan(&existing)
+		if err == nil {
+			ids[n.ID] = existing
+			continue
+		}
+		if err != sql.ErrNoRows {
+			return nil, fmt.Errorf("restore %s %q: %w", table, n.Name, err)
+		}
+
+		res, err := tx.Exec(insert, append([]any{id(n.ID)}, args...)...)
+		if err != nil {
+			return nil, fmt.Errorf("restore %s %q: %w", table, n.Name, err)
+		}
+		if ids[n.ID], err = res.LastInsertId(); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+func insertLink(
+	tx *sql.Tx,
+	table, leftColumn, rightColumn string,
+	leftIDs map[int64]int64, left int64,
+	rightIDs map[int64]int64, right int64,
+) error {
+	l, ok := leftIDs[left]
+	if !ok {
+		return fmt.Errorf("%s references unknown %s %d", table, leftColumn, left)
+	}
+	r, ok := rightIDs[right]
+	if !ok {
+		return fmt.Errorf("%s references unknown %s %d", table, rightColumn, right)
+	}
+
+	query := fmt.Sprintf(`INSERT OR IGNORE INTO %s (%s, %s) VALUES (?, ?);`, table, leftColumn, rightColumn)
+	if _, err := tx.Exec(query, l, r); err != nil {
+		return fmt.Errorf("restore %s: %w", table, err)
+	}
+	return nil
+}
+
+func queryRows(tx *sql.Tx, query string, scan func(*sql.Rows) error) error {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,237 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// migrations upgrade the tables created by InitDB. They run in order, each
+// in its own transaction, and the applied versions are recorded in
+// schema_migrations. Only ever append to this list.
+var migrations = []string{
+	// 1: user accounts, sessions and per-user ownership
+	`
+  CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username TEXT UNIQUE,
+    password_hash TEXT,
+    role TEXT DEFAULT 'user',
+    created_on INTEGER
+  );
+  CREATE TABLE IF NOT EXISTS sessions (
+    token_hash TEXT PRIMARY KEY,
+    user_id INTEGER,
+    created_on INTEGER,
+    expires_on INTEGER,
+    FOREIGN KEY (user_id) REFERENCES users (id)
+  );
+  ALTER TABLE books ADD COLUMN user_id INTEGER REFERENCES users (id);
+  ALTER TABLE entries ADD COLUMN user_id INTEGER REFERENCES users (id);
+  CREATE INDEX books_user_id ON books (user_id);
+  CREATE INDEX entries_user_id ON entries (user_id);
+
+  CREATE TABLE tags_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER,
+    name TEXT,
+    FOREIGN KEY (user_id) REFERENCES users (id),
+    UNIQUE (user_id, name)
+  );
+  INSERT INTO tags_new (id, name) SELECT id, name FROM tags;
+  DROP TABLE tags;
+  ALTER TABLE tags_new RENAME TO tags;
+
+  CREATE TABLE collections_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER,
+    name TEXT,
+    FOREIGN KEY (user_id) REFERENCES users (id),
+    UNIQUE (user_id, name)
+  );
+  INSERT INTO collections_new (id, name) SELECT id, name FROM collections;
+  DROP TABLE collections;
+  ALTER TABLE collections_new RENAME TO collections;
+
+  CREATE TABLE export_templates_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER,
+    name TEXT,
+    body TEXT,
+    updated_on INTEGER,
+    FOREIGN KEY (user_id) REFERENCES users (id),
+    UNIQUE (user_id, name)
+  );
+  INSERT INTO export_templates_new (id, name, body, updated_on)
+    SELECT id, name, body, updated_on FROM export_templates;
+  DROP TABLE export_templates;
+  ALTER TABLE export_templates_new RENAME TO export_templates;
+  `,
+	// 2: personal API tokens
+	`
+  CREATE TABLE IF NOT EXISTS api_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER,
+    name TEXT,
+    token_hash TEXT UNIQUE,
+    scopes TEXT,
+    created_on INTEGER,
+    last_used_on INTEGER,
+    FOREIGN KEY (user_id) REFERENCES users (id)
+  );
+  CREATE INDEX api_tokens_user_id ON api_tokens (user_id);
+  `,
+	// 3: accounts linked to an OpenID Connect provider
+	`
+  ALTER TABLE users ADD COLUMN oidc_issuer TEXT;
+  ALTER TABLE users ADD COLUMN oidc_subject TEXT;
+  CREATE UNIQUE INDEX users_oidc ON users (oidc_issuer, oidc_subject);
+  `,
+	// 4: per-session CSRF tokens, older sessions have none and must log in again
+	`
+  DELETE FROM sessions;
+  ALTER TABLE sessions ADD COLUMN csrf_token TEXT;
+  `,
+	// 5: read-only share links for a book's highlights
+	`
+  CREATE TABLE IF NOT EXISTS share_links (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER,
+    book_id INTEGER,
+    token TEXT UNIQUE,
+    hide_notes INTEGER DEFAULT 0,
+    created_on INTEGER,
+    expires_on INTEGER,
+    FOREIGN KEY (user_id) REFERENCES users (id),
+    FOREIGN KEY (book_id) REFERENCES books (id)
+  );
+  CREATE INDEX share_links_user_id ON share_links (user_id);
+  `,
+	// 6: KOReader progress sync
+	`
+  ALTER TABLE books ADD COLUMN md5 TEXT;
+  CREATE INDEX books_md5 ON books (user_id, md5);
+  ALTER TABLE users ADD COLUMN sync_key_hash TEXT;
+  CREATE TABLE IF NOT EXISTS kosync_progress (
+    user_id INTEGER,
+    document TEXT,
+    progress TEXT,
+    percentage REAL,
+    device TEXT,
+    device_id TEXT,
+    timestamp INTEGER,
+    PRIMARY KEY (user_id, document),
+    FOREIGN KEY (user_id) REFERENCES users (id)
+  );
+  `,
+	// 7: history of uploaded and watched imports
+	`
+  CREATE TABLE IF NOT EXISTS import_history (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER,
+    source TEXT,
+    name TEXT,
+    checksum TEXT,
+    status TEXT,
+    error TEXT,
+    books INTEGER DEFAULT 0,
+    entries INTEGER DEFAULT 0,
+    created_on INTEGER,
+    FOREIGN KEY (user_id) REFERENCES users (id)
+  );
+  CREATE INDEX import_history_checksum ON import_history (user_id, checksum);
+  `,
+	// 8: background jobs, and the files of queued imports
+	`
+  CREATE TABLE IF NOT EXISTS jobs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER,
+    kind TEXT,
+    status TEXT,
+    attempts INTEGER DEFAULT 0,
+    max_attempts INTEGER DEFAULT 1,
+    error TEXT,
+    run_after INTEGER,
+    created_on INTEGER,
+    updated_on INTEGER,
+    FOREIGN KEY (user_id) REFERENCES users (id)
+  );
+  CREATE INDEX jobs_status ON jobs (status, run_after);
+  CREATE TABLE IF NOT EXISTS import_files (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    job_id INTEGER,
+    name TEXT,
+    data BLOB,
+    status TEXT,
+    error TEXT,
+    books INTEGER DEFAULT 0,
+    entries INTEGER DEFAULT 0,
+    FOREIGN KEY (job_id) REFERENCES jobs (id)
+  );
+  CREATE INDEX import_files_job_id ON import_files (job_id);
+  `,
+	// 9: sorting the book table by highlight count and date
+	`
+  CREATE INDEX entries_book_id ON entries (book_id, time);
+  `,
+}
+
+// Migrate applies every migration that has not run yet.
+func (db DB) Migrate() error {
+	return db.migrateTo(len(migrations))
+}
+
+// migrateTo applies the migrations that have not run yet up to version.
+func (db DB) migrateTo(target int) error {
+	createMigrations := `
+  CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    applied_on INTEGER
+  );
+  `
+	if _, err := db.Exec(createMigrations); err != nil {
+		return err
+	}
+
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < target; i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_on) VALUES (?, ?);`, i+1, time.Now().Unix()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// SchemaVersion returns the number of migrations applied to the database.
+func (db DB) SchemaVersion() (int, error) {
+	var version int
+	err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations;`).Scan(&version)
+	return version, err
+}
+
+// LatestSchemaVersion is the version the database has once Migrate is done.
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+// PendingMigrations counts the migrations Migrate has yet to apply.
+func (db DB) PendingMigrations() (int, error) {
+	version, err := db.SchemaVersion()
+	return len(migrations) - version, err
+}
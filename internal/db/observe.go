@@ -0,0 +1,117 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/parthshahp/booknotes/internal/metrics"
+)
+
+// driverName is the SQLite driver with every statement timed for the
+// booknotes_db_query_duration_seconds metric.
+const driverName = "sqlite3_observed"
+
+func init() {
+	sql.Register(driverName, observedDriver{&sqlite3.SQLiteDriver{}})
+}
+
+type observedDriver struct {
+	driver.Driver
+}
+
+func (d observedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &observedConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+// observedConn times statements run on a connection. A query is timed until
+// its rows are closed, since SQLite does most of the work while they are
+// read.
+type observedConn struct {
+	*sqlite3.SQLiteConn
+}
+
+func (c *observedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *observedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.SQLiteConn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &observedStmt{stmt.(*sqlite3.SQLiteStmt)}, nil
+}
+
+func (c *observedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	defer observe("exec", start)
+	return c.SQLiteConn.ExecContext(ctx, query, args)
+}
+
+func (c *observedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := c.SQLiteConn.QueryContext(ctx, query, args)
+	if err != nil {
+		observe("query", start)
+		return nil, err
+	}
+	return &observedRows{Rows: rows, start: start}, nil
+}
+
+type observedStmt struct {
+	*sqlite3.SQLiteStmt
+}
+
+func (s *observedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	start := time.Now()
+	defer observe("exec", start)
+	return s.SQLiteStmt.Exec(args)
+}
+
+func (s *observedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	defer observe("exec", start)
+	return s.SQLiteStmt.ExecContext(ctx, args)
+}
+
+func (s *observedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := s.SQLiteStmt.Query(args)
+	if err != nil {
+		observe("query", start)
+		return nil, err
+	}
+	return &observedRows{Rows: rows, start: start}, nil
+}
+
+func (s *observedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := s.SQLiteStmt.QueryContext(ctx, args)
+	if err != nil {
+		observe("query", start)
+		return nil, err
+	}
+	return &observedRows{Rows: rows, start: start}, nil
+}
+
+type observedRows struct {
+	driver.Rows
+	start time.Time
+}
+
+func (r *observedRows) Close() error {
+	defer observe("query", r.start)
+	return r.Rows.Close()
+}
+
+func observe(op string, start time.Time) {
+	metrics.DBQueryDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,274 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/parthshahp/booknotes/internal/db"
+	"github.com/parthshahp/booknotes/internal/metrics"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+// pollInterval is how often idle workers look for jobs due for a retry.
+const pollInterval = time.Second
+
+type Job struct {
+	ID          int
+	UserID      int
+	Kind        string
+	Status      string
+	Attempts    int
+	MaxAttempts int
+	Error       string
+	CreatedOn   time.Time
+	UpdatedOn   time.Time
+}
+
+// Finished reports whether the job will not run again.
+func (j Job) Finished() bool {
+	return j.Status == JobDone || j.Status == JobFailed
+}
+
+// Handler runs a job. Returning an error runs the job again later until it
+// has been attempted MaxAttempts times, so handlers must be able to pick up
+// where a failed attempt left off.
+type Handler func(ctx context.Context, job Job) error
+
+// FailureHandler cleans up after a job that has failed for good, with the
+// error of its last attempt.
+type FailureHandler func(job Job, err error)
+
+// Queue runs jobs stored in the jobs table on a pool of workers. Jobs
+// survive restarts, ones interrupted while running are started again.
+type Queue struct {
+	db  *db.DB
+	env *Env
+
+	mu       sync.Mutex
+	handlers map[string]Handler
+	failures map[string]FailureHandler
+	wake     chan struct{}
+}
+
+func NewQueue(db *db.DB, env *Env) *Queue {
+	return &Queue{
+		db:       db,
+		env:      env,
+		handlers: map[string]Handler{},
+		failures: map[string]FailureHandler{},
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Handle registers the handler for jobs of kind.
+func (q *Queue) Handle(kind string, handler Handler) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handlers[kind] = handler
+}
+
+// HandleFailure registers the handler run once a job of kind has used up
+// its attempts.
+func (q *Queue) HandleFailure(kind string, handler FailureHandler) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.failures[kind] = handler
+}
+
+// Enqueue adds a job for the user as part of tx, so the job's own data can
+// be stored with it.
+func (q *Queue) Enqueue(tx *sql.Tx, userID int, kind string, maxAttempts int) (int, error) {
+	now := time.Now().Unix()
+	res, err := tx.Exec(`
+    INSERT INTO jobs (user_id, kind, status, attempts, max_attempts, run_after, created_on, updated_on)
+    VALUES (?, ?, ?, 0, ?, ?, ?, ?);
+  `, userID, kind, JobQueued, maxAttempts, now, now, now)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// Wake tells an idle worker there is work. Call it once the transaction
+// that enqueued the job has committed.
+func (q *Queue) Wake() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Get returns one of the user's jobs.
+func (q *Queue) Get(userID, id int) (Job, error) {
+	rows, err := q.db.Query(selectJobs+` WHERE id = ? AND user_id = ?;`, id, userID)
+	if err != nil {
+		return Job{}, err
+	}
+	jobs, err := scanJobs(rows)
+	if err != nil {
+		return Job{}, err
+	}
+	if len(jobs) == 0 {
+		return Job{}, sql.ErrNoRows
+	}
+	return jobs[0], nil
+}
+
+// Active returns the user's jobs of kind that haven't finished, oldest first.
+func (q *Queue) Active(userID int, kind string) ([]Job, error) {
+	rows, err := q.db.Query(selectJobs+` WHERE user_id = ? AND kind = ? AND status IN (?, ?) ORDER BY id;`,
+		userID, kind, JobQueued, JobRunning)
+	if err != nil {
+		return nil, err
+	}
+	return scanJobs(rows)
+}
+
+const selectJobs = `SELECT id, user_id, kind, status, attempts, max_attempts, COALESCE(error, ''), created_on, updated_on FROM jobs`
+
+func scanJobs(rows *sql.Rows) ([]Job, error) {
+	defer rows.Close()
+	var jobs []Job
+	for rows.Next() {
+		var job Job
+		var createdOn, updatedOn int64
+		if err := rows.Scan(&job.ID, &job.UserID, &job.Kind, &job.Status, &job.Attempts, &job.MaxAttempts,
+			&job.Error, &createdOn, &updatedOn); err != nil {
+			return nil, err
+		}
+		job.CreatedOn = time.Unix(createdOn, 0)
+		job.UpdatedOn = time.Unix(updatedOn, 0)
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// Run starts the workers and blocks until ctx is cancelled and the jobs
+// they were running have stopped. Handlers see the cancelled ctx and should
+// return at the next point they can resume from.
+func (q *Queue) Run(ctx context.Context, workers int) {
+	// Jobs still running were interrupted by a restart
+	if _, err := q.db.Exec(`UPDATE jobs SET status = ? WHERE status = ?;`, JobQueued, JobRunning); err != nil {
+		q.env.Logger.Error("Failed to requeue interrupted jobs", "err", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *Queue) work(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		// Drain the queue before waiting again
+		for ctx.Err() == nil {
+			job, err := q.claim()
+			if err == sql.ErrNoRows {
+				break
+			}
+			if err != nil {
+				q.env.Logger.Error("Failed to claim job", "err", err)
+				break
+			}
+			q.run(ctx, job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim marks the oldest due job as running and returns it. The single
+// UPDATE keeps two workers from claiming the same job.
+func (q *Queue) claim() (Job, error) {
+	now := time.Now().Unix()
+	rows, err := q.db.Query(`
+    UPDATE jobs SET status = ?, attempts = attempts + 1, updated_on = ?
+    WHERE id = (SELECT id FROM jobs WHERE status = ? AND run_after <= ? ORDER BY id LIMIT 1)
+    RETURNING id, user_id, kind, status, attempts, max_attempts, COALESCE(error, ''), created_on, updated_on;
+  `, JobRunning, now, JobQueued, now)
+	if err != nil {
+		return Job{}, err
+	}
+	jobs, err := scanJobs(rows)
+	if err != nil {
+		return Job{}, err
+	}
+	if len(jobs) == 0 {
+		return Job{}, sql.ErrNoRows
+	}
+	return jobs[0], nil
+}
+
+func (q *Queue) run(ctx context.Context, job Job) {
+	q.mu.Lock()
+	handler, ok := q.handlers[job.Kind]
+	onFailure := q.failures[job.Kind]
+	q.mu.Unlock()
+
+	var err error
+	if !ok {
+		err = fmt.Errorf("no handler for %s jobs", job.Kind)
+		job.Attempts = job.MaxAttempts
+	} else {
+		err = q.call(ctx, handler, job)
+	}
+
+	status, runAfter, msg, result := JobDone, time.Now(), "", "done"
+	if err != nil && ctx.Err() != nil {
+		// Stopped by a shutdown, the attempt doesn't count
+		q.env.Logger.Info("Job interrupted, it will resume on the next start", "job", job.ID, "kind", job.Kind)
+		metrics.Jobs.WithLabelValues(job.Kind, "interrupted").Inc()
+		_, dbErr := q.db.Exec(`UPDATE jobs SET status = ?, attempts = attempts - 1, updated_on = ? WHERE id = ?;`,
+			JobQueued, time.Now().Unix(), job.ID)
+		if dbErr != nil {
+			q.env.Logger.Error("Failed to update job", "job", job.ID, "err", dbErr)
+		}
+		return
+	}
+	if err != nil {
+		msg = err.Error()
+		status, result = JobFailed, "failed"
+		if job.Attempts < job.MaxAttempts {
+			// Back off 10s, 40s, 90s, ...
+			status, result = JobQueued, "retry"
+			runAfter = runAfter.Add(time.Duration(job.Attempts*job.Attempts) * 10 * time.Second)
+		}
+		q.env.Logger.Error("Job attempt failed", "job", job.ID, "kind", job.Kind, "attempt", job.Attempts, "err", err)
+	}
+	metrics.Jobs.WithLabelValues(job.Kind, result).Inc()
+
+	_, dbErr := q.db.Exec(`UPDATE jobs SET status = ?, error = ?, run_after = ?, updated_on = ? WHERE id = ?;`,
+		status, msg, runAfter.Unix(), time.Now().Unix(), job.ID)
+	if dbErr != nil {
+		q.env.Logger.Error("Failed to update job", "job", job.ID, "err", dbErr)
+	}
+	if status == JobFailed && onFailure != nil {
+		onFailure(job, err)
+	}
+}
+
+// call runs the handler, turning a panic into a failed attempt.
+func (q *Queue) call(ctx context.Context, handler Handler, job Job) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return handler(ctx, job)
+}
@@ -0,0 +1,85 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+// New returns a logger writing cfg.Format records to w at cfg.Level and
+// above. Records logged with a request's context carry its request_id.
+func New(w io.Writer, cfg LogConfig) *slog.Logger {
+	var level slog.Level
+	level.UnmarshalText([]byte(cfg.Level))
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if cfg.Format == LogJSON {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(contextHandler{handler})
+}
+
+// Request is what is known about the request being served. The access log
+// reads it once the handlers have filled it in.
+type Request struct {
+	ID   string
+	User string
+}
+
+type requestKey struct{}
+
+// WithRequest starts tracking a request, reusing id when the client or a
+// proxy sent one.
+func WithRequest(ctx context.Context, id string) (context.Context, *Request) {
+	if id == "" || len(id) > 64 {
+		id = NewRequestID()
+	}
+	req := &Request{ID: id}
+	return context.WithValue(ctx, requestKey{}, req), req
+}
+
+// FromContext returns the request ctx belongs to, or nil outside of one.
+func FromContext(ctx context.Context) *Request {
+	req, _ := ctx.Value(requestKey{}).(*Request)
+	return req
+}
+
+// SetUser records who the request was made by for the access log.
+func SetUser(ctx context.Context, username string) {
+	if req := FromContext(ctx); req != nil {
+		req.User = username
+	}
+}
+
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// contextHandler adds the request_id of the record's context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if req := FromContext(ctx); req != nil {
+		r.AddAttrs(slog.String("request_id", req.ID))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
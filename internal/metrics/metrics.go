@@ -0,0 +1,128 @@
+// Package metrics holds the Prometheus metrics served on /metrics. They are
+// kept in their own registry, alongside the Go runtime and process
+// collectors.
+package metrics
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var registry = prometheus.NewRegistry()
+
+var (
+	// HTTPRequests is labelled by the ServeMux pattern that matched rather
+	// than the path, so IDs in URLs don't make a series each
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "booknotes_http_requests_total",
+		Help: "HTTP requests served, by method, route pattern and status code.",
+	}, []string{"method", "route", "status"})
+
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "booknotes_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests, by method and route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	DBQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "booknotes_db_query_duration_seconds",
+		Help:    "Time taken by database statements, by exec or query.",
+		Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"op"})
+
+	// Jobs counts attempts by how they ended: done, retry, failed or
+	// interrupted
+	Jobs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "booknotes_jobs_total",
+		Help: "Background job attempts, by kind and result.",
+	}, []string{"kind", "result"})
+
+	Imports = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "booknotes_imports_total",
+		Help: "Imported files, by source and status.",
+	}, []string{"source", "status"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPDuration,
+		DBQueryDuration,
+		Jobs,
+		Imports,
+	)
+}
+
+// WatchLibrary reports the size of the library in db across all users. The
+// counts are taken when the metrics are scraped.
+func WatchLibrary(db *sql.DB) {
+	registry.MustRegister(libraryCollector{db})
+}
+
+var libraryGauges = []struct {
+	desc  *prometheus.Desc
+	query string
+}{
+	{
+		prometheus.NewDesc("booknotes_library_books", "Books in the library.", nil, nil),
+		`SELECT COUNT(*) FROM books;`,
+	},
+	{
+		prometheus.NewDesc("booknotes_library_entries", "Highlights and notes in the library.", nil, nil),
+		`SELECT COUNT(*) FROM entries;`,
+	},
+	{
+		prometheus.NewDesc("booknotes_library_authors", "Authors in the library.", nil, nil),
+		`SELECT COUNT(*) FROM authors;`,
+	},
+}
+
+type libraryCollector struct {
+	db *sql.DB
+}
+
+func (c libraryCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, g := range libraryGauges {
+		ch <- g.desc
+	}
+}
+
+func (c libraryCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, g := range libraryGauges {
+		var n int
+		if err := c.db.QueryRowContext(ctx, g.query).Scan(&n); err != nil {
+			ch <- prometheus.NewInvalidMetric(g.desc, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, float64(n))
+	}
+}
+
+// Handler serves the metrics in the Prometheus text format. When token is
+// set scrapers must send it as a bearer token.
+func Handler(token string) http.Handler {
+	metrics := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		metrics.ServeHTTP(w, r)
+	})
+}
@@ -1,13 +1,204 @@
 package types
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"net/url"
 	"time"
 )
 
 type Env struct {
-	InfoLog  *log.Logger
-	ErrorLog *log.Logger
+	Logger  *slog.Logger
+	HTTP    HTTPConfig
+	TLS     TLSConfig
+	Backup  BackupConfig
+	Auth    AuthConfig
+	CORS    CORSConfig
+	Import  ImportConfig
+	Watch   WatchConfig
+	Jobs    JobsConfig
+	Metrics MetricsConfig
+}
+
+// HTTPConfig describes how requests reach the server. BasePath mounts
+// every page below a path prefix such as /booknotes. Requests from
+// TrustedProxies, given as IP addresses or CIDR ranges, may set
+// X-Forwarded-Prefix and X-Forwarded-Proto for a proxy that strips its own
+// prefix or terminates TLS.
+type HTTPConfig struct {
+	BasePath       string   `toml:"base_path" yaml:"base_path"`
+	TrustedProxies []string `toml:"trusted_proxies" yaml:"trusted_proxies"`
+}
+
+// ParseTrustedProxy reads an entry of TrustedProxies, a single address
+// being a range of one.
+func ParseTrustedProxy(s string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%q is not an IP address or CIDR range", s)
+	}
+	return prefix.Masked(), nil
+}
+
+// TLSConfig serves HTTPS when both files are set. They are reloaded when
+// they change. RedirectAddr, when set, is a plain HTTP listener that
+// redirects to HTTPS. HTTPS responses carry a Strict-Transport-Security
+// header for HSTSMaxAge, zero leaves it out.
+type TLSConfig struct {
+	CertFile     string        `toml:"cert_file" yaml:"cert_file"`
+	KeyFile      string        `toml:"key_file" yaml:"key_file"`
+	RedirectAddr string        `toml:"redirect_addr" yaml:"redirect_addr"`
+	HSTSMaxAge   time.Duration `toml:"hsts_max_age" yaml:"hsts_max_age"`
+}
+
+// Enabled reports whether HTTPS is served.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// OIDCConfig enables single sign-on when Issuer is set. Members of
+// AdminGroups are made admins, and when UserGroups is set only members of
+// it or AdminGroups may sign in.
+type OIDCConfig struct {
+	Issuer       string   `toml:"issuer" yaml:"issuer"`
+	ClientID     string   `toml:"client_id" yaml:"client_id"`
+	ClientSecret string   `toml:"client_secret" yaml:"client_secret"`
+	RedirectURL  string   `toml:"redirect_url" yaml:"redirect_url"`
+	Scopes       []string `toml:"scopes" yaml:"scopes"`
+	GroupsClaim  string   `toml:"groups_claim" yaml:"groups_claim"`
+	AdminGroups  []string `toml:"admin_groups" yaml:"admin_groups"`
+	UserGroups   []string `toml:"user_groups" yaml:"user_groups"`
+	ButtonLabel  string   `toml:"button_label" yaml:"button_label"`
+}
+
+// CORSConfig lists the origins allowed to call the API from a browser. No
+// cross-origin requests are allowed when it is empty.
+type CORSConfig struct {
+	AllowedOrigins   []string `toml:"allowed_origins" yaml:"allowed_origins"`
+	AllowCredentials bool     `toml:"allow_credentials" yaml:"allow_credentials"`
+}
+
+// AuthConfig controls local accounts. The first account can always be
+// registered and becomes the admin, later sign ups need AllowSignup.
+type AuthConfig struct {
+	AllowSignup   bool          `toml:"allow_signup" yaml:"allow_signup"`
+	SecureCookies bool          `toml:"secure_cookies" yaml:"secure_cookies"`
+	SessionTTL    time.Duration `toml:"session_ttl" yaml:"session_ttl"`
+	OIDC          OIDCConfig    `toml:"oidc" yaml:"oidc"`
+}
+
+// BackupConfig controls the scheduled database snapshots. Backups are
+// disabled when Dir is empty. KeepDaily and KeepWeekly set how many daily
+// and weekly snapshots survive pruning, zero for both keeps everything.
+type BackupConfig struct {
+	Dir        string        `toml:"dir" yaml:"dir"`
+	Interval   time.Duration `toml:"interval" yaml:"interval"`
+	KeepDaily  int           `toml:"keep_daily" yaml:"keep_daily"`
+	KeepWeekly int           `toml:"keep_weekly" yaml:"keep_weekly"`
+}
+
+// ImportConfig limits uploads to MaxUploadMB megabytes per request.
+type ImportConfig struct {
+	MaxUploadMB int `toml:"max_upload_mb" yaml:"max_upload_mb"`
+}
+
+// MaxUploadBytes is MaxUploadMB in bytes.
+func (c ImportConfig) MaxUploadBytes() int64 {
+	return int64(c.MaxUploadMB) << 20
+}
+
+// WatchConfig enables importing files dropped into Dir. They are imported
+// for User, or the first admin when User is empty. Dir is rescanned every
+// Interval in case file system events are missed.
+type WatchConfig struct {
+	Dir      string        `toml:"dir" yaml:"dir"`
+	User     string        `toml:"user" yaml:"user"`
+	Interval time.Duration `toml:"interval" yaml:"interval"`
+}
+
+// JobsConfig sizes the pool of background job workers.
+type JobsConfig struct {
+	Workers int `toml:"workers" yaml:"workers"`
+}
+
+// MetricsConfig serves Prometheus metrics on /metrics when Enabled. When
+// Token is set scrapers must send it as a bearer token, otherwise anyone
+// can read the metrics, so they are off by default.
+type MetricsConfig struct {
+	Enabled bool   `toml:"enabled" yaml:"enabled"`
+	Token   string `toml:"token" yaml:"token"`
+}
+
+// LogConfig sets the lowest level logged and whether records are written
+// as text or JSON.
+type LogConfig struct {
+	Level  string `toml:"level" yaml:"level"`
+	Format string `toml:"format" yaml:"format"`
+}
+
+const (
+	LogDebug = "debug"
+	LogInfo  = "info"
+	LogWarn  = "warn"
+	LogError = "error"
+
+	LogText = "text"
+	LogJSON = "json"
+)
+
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+type User struct {
+	ID        int
+	Username  string
+	Role      string
+	CreatedOn time.Time
+}
+
+// API token scopes. The admin scope grants every other scope.
+const (
+	ScopeRead   = "read"
+	ScopeImport = "import"
+	ScopeAdmin  = "admin"
+)
+
+var Scopes = []string{ScopeRead, ScopeImport, ScopeAdmin}
+
+// ShareLink gives read-only access to one book's highlights. A zero
+// ExpiresOn means the link never expires.
+type ShareLink struct {
+	ID        int
+	Token     string
+	BookID    int
+	BookTitle string
+	HideNotes bool
+	CreatedOn time.Time
+	ExpiresOn time.Time
+}
+
+type ApiToken struct {
+	ID         int
+	Name       string
+	Scopes     []string
+	CreatedOn  time.Time
+	LastUsedOn time.Time
+}
+
+// HasScope reports whether the token grants scope.
+func (t ApiToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
 }
 
 type Entry struct {
@@ -19,12 +210,20 @@ type Entry struct {
 	Note    string `json:"note"`
 }
 
+// BookEntry is a highlight along with the book it is from.
+type BookEntry struct {
+	Entry
+	BookID    int
+	BookTitle string
+}
+
 type BookImport struct {
 	EpochCreatedOn int64   `json:"created_on"`
 	NumberOfPages  int     `json:"number_of_pages"`
 	Title          string  `json:"title"`
 	Entries        []Entry `json:"entries"`
 	Author         string  `json:"author"`
+	MD5            string  `json:"md5sum,omitempty"`
 }
 
 type Book struct {
@@ -34,4 +233,217 @@ type Book struct {
 	Title         string
 	EntryCount    int
 	Authors       []string
+	// Tags and Collections are the user's own names the book is filed under
+	Tags        []string
+	Collections []string
+	// LastEntryOn is when the newest highlight was made, zero without any
+	LastEntryOn time.Time
+	// MD5 is KOReader's partial md5 of the document, used to match progress
+	MD5      string
+	Progress ReadingProgress
+}
+
+// Author is someone credited on books, with counts over one user's books.
+type Author struct {
+	ID         int
+	Name       string
+	BookCount  int
+	EntryCount int
+}
+
+// Columns the book table can be sorted on
+const (
+	SortTitle       = "title"
+	SortAuthor      = "author"
+	SortHighlights  = "highlights"
+	SortCreated     = "created"
+	SortLastEntry   = "last_highlight"
+	SortAscending   = "asc"
+	SortDescending  = "desc"
+	DefaultBookSort = SortCreated
+)
+
+// BookQuery is the state of the book table: what it is searched for,
+// filtered and sorted by, and the cursor of the book the page starts
+// after. It lives in the URL so that views can be bookmarked. Dates use
+// the 2006-01-02 layout.
+type BookQuery struct {
+	Search     string
+	Author     string
+	Collection string
+	Tag        string
+	From       string
+	To         string
+	Sort       string
+	Desc       bool
+	After      string
+}
+
+// DefaultBookQuery shows the newest books first.
+func DefaultBookQuery() BookQuery {
+	return BookQuery{Sort: DefaultBookSort, Desc: true}
+}
+
+// Values encodes q as query parameters, leaving out the defaults.
+func (q BookQuery) Values() url.Values {
+	values := url.Values{}
+	for _, p := range []struct{ key, value string }{
+		{"q", q.Search},
+		{"author", q.Author},
+		{"collection", q.Collection},
+		{"tag", q.Tag},
+		{"from", q.From},
+		{"to", q.To},
+		{"after", q.After},
+	} {
+		if p.value != "" {
+			values.Set(p.key, p.value)
+		}
+	}
+	def := DefaultBookQuery()
+	if q.Sort != def.Sort || q.Desc != def.Desc {
+		values.Set("sort", q.Sort)
+		values.Set("order", SortAscending)
+		if q.Desc {
+			values.Set("order", SortDescending)
+		}
+	}
+	return values
+}
+
+// Filtered reports whether the query hides any books.
+func (q BookQuery) Filtered() bool {
+	return q.Search != "" || q.Author != "" || q.Collection != "" || q.Tag != "" || q.From != "" || q.To != ""
+}
+
+// SortBy returns the first page of q sorted on column. Sorting on the
+// current column again reverses the order, a new column starts from A to Z
+// for text and from the most recent or largest for the others.
+func (q BookQuery) SortBy(column string) BookQuery {
+	if q.Sort == column {
+		q.Desc = !q.Desc
+	} else {
+		q.Sort = column
+		q.Desc = column != SortTitle && column != SortAuthor
+	}
+	q.After = ""
+	return q
+}
+
+// Page returns q starting after the book with cursor, "" for the first page.
+func (q BookQuery) Page(cursor string) BookQuery {
+	q.After = cursor
+	return q
+}
+
+// BookPage is one page of the book table along with what it can be
+// filtered by. Next is the cursor of the following page, empty on the last.
+type BookPage struct {
+	Query       BookQuery
+	Books       []Book
+	Next        string
+	Authors     []string
+	Collections []string
+	Tags        []string
+}
+
+// ReadingProgress is the last position a KOReader device synced for a
+// document. A zero UpdatedOn means nothing has been synced.
+type ReadingProgress struct {
+	Document   string    `json:"document"`
+	Progress   string    `json:"progress"`
+	Percentage float64   `json:"percentage"`
+	Device     string    `json:"device"`
+	DeviceID   string    `json:"device_id"`
+	UpdatedOn  time.Time `json:"-"`
+}
+
+type ExportTemplate struct {
+	ID        int
+	Name      string
+	Body      string
+	UpdatedOn time.Time
+}
+
+// ExportBook is the data model handed to user-defined export templates.
+// Book holds the book metadata, Authors the author names and Entries every
+// highlight in export order. Chapters holds the same highlights grouped by
+// chapter in order of first appearance, while Groups follows the grouping
+// mode requested for the export (chapter, page or none).
+type ExportBook struct {
+	Book       Book
+	Authors    []string
+	Chapters   []ExportGroup
+	Groups     []ExportGroup
+	Entries    []Entry
+	ExportedOn time.Time
+}
+
+type ExportGroup struct {
+	Title   string
+	Entries []Entry
+}
+
+// Sources and outcomes recorded in the import history
+const (
+	ImportSourceUpload = "upload"
+	ImportSourceWatch  = "watch"
+	ImportSourceCLI    = "cli"
+
+	ImportDone      = "done"
+	ImportFailed    = "failed"
+	ImportDuplicate = "duplicate"
+)
+
+type ImportRecord struct {
+	ID        int
+	Source    string
+	Name      string
+	Checksum  string
+	Status    string
+	Error     string
+	Books     int
+	Entries   int
+	CreatedOn time.Time
+}
+
+// Background job states, queued and running also apply to the files of an
+// import job
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// ImportJob is a queued upload and the progress of each of its files.
+type ImportJob struct {
+	ID     int
+	Status string
+	Error  string
+	Files  []ImportJobFile
+}
+
+type ImportJobFile struct {
+	Name    string
+	Status  string
+	Error   string
+	Books   int
+	Entries int
+}
+
+// Finished reports whether every file has been processed or the job gave up.
+func (j ImportJob) Finished() bool {
+	return j.Status == JobDone || j.Status == JobFailed
+}
+
+// Processed counts the files that have been imported or have failed.
+func (j ImportJob) Processed() int {
+	n := 0
+	for _, f := range j.Files {
+		if f.Status != JobQueued && f.Status != JobRunning {
+			n++
+		}
+	}
+	return n
 }
@@ -0,0 +1,194 @@
+package watch
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/parthshahp/booknotes/internal/api"
+	"github.com/parthshahp/booknotes/internal/db"
+	. "github.com/parthshahp/booknotes/internal/types"
+)
+
+// Processed files are moved into these folders of the watched directory
+const (
+	DoneDir   = "done"
+	FailedDir = "failed"
+)
+
+// settleDelay is how long a file must go unmodified before it is read, so
+// files still being copied in are left alone.
+const settleDelay = 2 * time.Second
+
+// Run imports the files that appear in env.Watch.Dir until ctx is
+// cancelled. File system events trigger a scan once they settle, and the
+// directory is scanned every env.Watch.Interval regardless, for file
+// systems such as network shares that don't report changes.
+func Run(ctx context.Context, db *db.DB, env *Env) {
+	cfg := env.Watch
+	if cfg.Dir == "" {
+		return
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		env.Logger.Error("Failed to create watch directory", "err", err)
+		return
+	}
+	env.Logger.Info("Watching for imports", "dir", cfg.Dir)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		env.Logger.Error("Failed to watch, polling instead", "dir", cfg.Dir, "err", err)
+	} else {
+		defer watcher.Close()
+	}
+	var events chan fsnotify.Event
+	var errs chan error
+	if watcher != nil {
+		events, errs = watcher.Events, watcher.Errors
+	}
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	settle := time.NewTimer(0)
+	defer settle.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			if event.Has(fsnotify.Create) || event.Has(fsnotify.Write) || event.Has(fsnotify.Rename) {
+				settle.Reset(settleDelay)
+			}
+		case err := <-errs:
+			env.Logger.Error("Watch error", "err", err)
+		case <-ticker.C:
+			settle.Reset(0)
+		case <-settle.C:
+			if pending := Scan(ctx, db, env, watcher); pending {
+				settle.Reset(settleDelay)
+			}
+		}
+	}
+}
+
+// Scan imports every settled import file under the watched directory,
+// moving each one to done/ or failed/. It reports whether files were left
+// because they were still changing. Directories are added to watcher when
+// it isn't nil. Cancelling ctx stops the scan after the current file.
+func Scan(ctx context.Context, db *db.DB, env *Env, watcher *fsnotify.Watcher) (pending bool) {
+	cfg := env.Watch
+	userID, err := owner(db, cfg)
+	if err != nil {
+		env.Logger.Error("Not importing", "dir", cfg.Dir, "err", err)
+		return false
+	}
+
+	err = filepath.WalkDir(cfg.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(cfg.Dir, path)
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if rel == DoneDir || rel == FailedDir || (rel != "." && hidden(d.Name())) {
+				return filepath.SkipDir
+			}
+			if watcher != nil {
+				if err := watcher.Add(path); err != nil {
+					env.Logger.Error("Failed to watch", "dir", path, "err", err)
+				}
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || hidden(d.Name()) || !api.IsImportFile(d.Name()) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if time.Since(info.ModTime()) < settleDelay {
+			pending = true
+			return nil
+		}
+		importFile(db, env, userID, path, rel)
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		env.Logger.Error("Failed to scan", "dir", cfg.Dir, "err", err)
+	}
+	return pending
+}
+
+func importFile(db *db.DB, env *Env, userID int, path, rel string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		// Try again on the next scan
+		env.Logger.Error("Failed to read", "file", path, "err", err)
+		return
+	}
+
+	record, err := api.IngestFile(db, env, userID, ImportSourceWatch, filepath.ToSlash(rel), data)
+	dest := filepath.Join(env.Watch.Dir, DoneDir, rel)
+	if err != nil {
+		env.Logger.Error("Failed to import", "file", rel, "err", err)
+		dest = filepath.Join(env.Watch.Dir, FailedDir, rel)
+	} else {
+		env.Logger.Info("Imported", "file", rel, "books", record.Books, "entries", record.Entries)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		env.Logger.Error("Failed to move", "file", rel, "err", err)
+		return
+	}
+	if err := os.Rename(path, dest); err != nil {
+		env.Logger.Error("Failed to move", "file", rel, "err", err)
+		return
+	}
+	if err != nil {
+		// The error sits next to the file as name.error.txt
+		sidecar := dest + ".error.txt"
+		if err := os.WriteFile(sidecar, []byte(err.Error()+"\n"), 0o644); err != nil {
+			env.Logger.Error("Failed to write", "file", sidecar, "err", err)
+		}
+	}
+}
+
+// owner is the account watched files are imported for.
+func owner(db *db.DB, cfg WatchConfig) (int, error) {
+	var id int
+	var err error
+	if cfg.User != "" {
+		err = db.QueryRow(`SELECT id FROM users WHERE username = ?;`, cfg.User).Scan(&id)
+	} else {
+		err = db.QueryRow(`SELECT id FROM users WHERE role = ? ORDER BY id LIMIT 1;`, RoleAdmin).Scan(&id)
+	}
+	if err == sql.ErrNoRows {
+		if cfg.User != "" {
+			return 0, errors.New("unknown user " + cfg.User)
+		}
+		return 0, errors.New("no admin account yet")
+	}
+	return id, err
+}
+
+// hidden matches dot files and the temporary files sync tools write
+// before renaming them into place, such as Syncthing's ~syncthing~*.tmp.
+func hidden(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasPrefix(name, "~")
+}